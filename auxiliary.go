@@ -0,0 +1,52 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+
+	klog "k8s.io/klog/v2"
+)
+
+// The auxiliary API operations, as reported by the
+// hostpath_provisioner_auxiliary_failures_total metric
+const auxiliaryListVolumes = "list-volumes"
+const auxiliaryUpdateVolume = "update-volume"
+const auxiliaryPostEvent = "post-event"
+const auxiliaryListStorageClasses = "list-storage-classes"
+
+var auxiliaryOperations = []string{
+	auxiliaryListVolumes,
+	auxiliaryUpdateVolume,
+	auxiliaryPostEvent,
+	auxiliaryListStorageClasses,
+}
+
+// auxiliaryFailed applies the degradation policy to a failed auxiliary API
+// call, i.e. one the provisioner can do without. The failure is always
+// counted, but it's only returned (for the caller to fail on) in strict mode.
+// Otherwise it's logged as a warning, and nil is returned so the caller
+// carries on without it. All the code making auxiliary API calls should go
+// through here.
+func (p *HostPathProvisioner) auxiliaryFailed(operation string, err error) error {
+	auxiliaryFailuresTotal.WithLabelValues(operation).Inc()
+	if p.StrictAuxiliary {
+		return fmt.Errorf("the auxiliary %s operation failed: %w", operation, err)
+	}
+	klog.Warningf("The auxiliary %s operation failed, carrying on without it: %s", operation, err)
+	return nil
+}
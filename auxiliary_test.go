@@ -0,0 +1,138 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+// failAPI makes every call with the given verb on the given resource fail
+func failAPI(p *HostPathProvisioner, verb string, resource string) {
+	p.Client.(*fake.Clientset).PrependReactor(verb, resource, func(action k8stesting.Action) (bool, runtime.Object, error) {
+		return true, nil, errors.New("the API server is unavailable")
+	})
+}
+
+func TestSlowProvisionEventFails(t *testing.T) {
+	for _, strict := range []bool{false, true} {
+		name := "lenient"
+		if strict {
+			name = "strict"
+		}
+		t.Run(name, func(t *testing.T) {
+			p := newTestProvisioner(t)
+			p.StrictAuxiliary = strict
+			p.RollbackOnFailure = true
+			p.SlowProvisionThreshold = time.Nanosecond
+			p.SlowProvisionEvent = true
+			failAPI(p, "create", "events")
+
+			before := counterValue(t, auxiliaryFailuresTotal.WithLabelValues(auxiliaryPostEvent))
+			volume, _, err := p.Provision(context.Background(), testOptions("pv", testClaim("claim", nil), testClass("standard", nil)))
+			if got := counterValue(t, auxiliaryFailuresTotal.WithLabelValues(auxiliaryPostEvent)); got != before+1 {
+				t.Errorf("Expected the failed event to be counted once, the counter went %v -> %v", before, got)
+			}
+
+			_, statErr := os.Stat(path.Join(p.HostPathMount, "pv"))
+			if strict {
+				if err == nil || volume != nil {
+					t.Fatalf("Expected the provisioning to fail in strict mode")
+				}
+				if !os.IsNotExist(statErr) {
+					t.Errorf("The failed provisioning wasn't rolled back: %v", statErr)
+				}
+				return
+			}
+			if err != nil || volume == nil {
+				t.Fatalf("Expected the provisioning to succeed without the event, got %v", err)
+			}
+			if statErr != nil {
+				t.Errorf("The volume directory is missing: %s", statErr)
+			}
+		})
+	}
+}
+
+func TestStorageClassListingFails(t *testing.T) {
+	for _, strict := range []bool{false, true} {
+		name := "lenient"
+		if strict {
+			name = "strict"
+		}
+		t.Run(name, func(t *testing.T) {
+			p := newTestProvisioner(t)
+			p.StrictAuxiliary = strict
+			p.StorageClassCheck = storageClassCheckFatal
+			failAPI(p, "list", "storageclasses")
+
+			before := counterValue(t, auxiliaryFailuresTotal.WithLabelValues(auxiliaryListStorageClasses))
+			err := p.checkStorageClasses(context.Background(), "hostpath")
+			if got := counterValue(t, auxiliaryFailuresTotal.WithLabelValues(auxiliaryListStorageClasses)); got != before+1 {
+				t.Errorf("Expected the failed listing to be counted once, the counter went %v -> %v", before, got)
+			}
+			if strict && err == nil {
+				t.Errorf("Expected the check to fail in strict mode")
+			} else if !strict && err != nil {
+				t.Errorf("Expected the check to carry on without the listing, got %s", err)
+			}
+		})
+	}
+}
+
+func TestProvisionWithoutAPI(t *testing.T) {
+	// The core operations need nothing from the API, so they carry on even
+	// while every auxiliary call fails
+	p := newTestProvisioner(t)
+	p.MarkerFile = ".hostpath-marker"
+	p.ReconcileRepair = reconcileRepairFromMarker
+	p.SlowProvisionThreshold = time.Nanosecond
+	p.SlowProvisionEvent = true
+	p.StorageClassCheck = storageClassCheckWarn
+	for _, verb := range []string{"get", "list", "create", "update"} {
+		failAPI(p, verb, "*")
+	}
+
+	before := map[string]float64{}
+	for _, operation := range auxiliaryOperations {
+		before[operation] = counterValue(t, auxiliaryFailuresTotal.WithLabelValues(operation))
+	}
+	volume, _, err := p.Provision(context.Background(), testOptions("pv", testClaim("claim", nil), testClass("standard", nil)))
+	if err != nil {
+		t.Fatalf("Provisioning failed: %s", err)
+	}
+	p.reconcileMarkers(context.Background())
+	if err := p.checkStorageClasses(context.Background(), "hostpath"); err != nil {
+		t.Errorf("The StorageClass check failed: %s", err)
+	}
+	if err := p.Delete(context.Background(), volume); err != nil {
+		t.Fatalf("Deletion failed: %s", err)
+	}
+	for _, operation := range []string{auxiliaryPostEvent, auxiliaryListVolumes, auxiliaryListStorageClasses} {
+		if got := counterValue(t, auxiliaryFailuresTotal.WithLabelValues(operation)); got != before[operation]+1 {
+			t.Errorf("Expected the failed %s operation to be counted once, the counter went %v -> %v", operation, before[operation], got)
+		}
+	}
+}
@@ -0,0 +1,361 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"sigs.k8s.io/sig-storage-lib-external-provisioner/v13/controller"
+
+	v1 "k8s.io/api/core/v1"
+	klog "k8s.io/klog/v2"
+)
+
+const directoryBackendName = "directory"
+const tmpfsBackendName = "tmpfs"
+const bindReadOnlyBackendName = "bind-ro"
+
+// The StorageClass parameter holding the shared source directory for the
+// bind-ro backend
+const sourceParameter = "source"
+
+// The StorageClass parameter holding the percentage of the requested size the
+// tmpfs and quota backends reserve, on top of it, for the file system's metadata
+const metadataReserveParameter = "metadataReserve"
+
+// The PV annotation recording the size the tmpfs and quota backends actually
+// enforce, which includes the metadata reserve (the PV's capacity doesn't)
+const enforcedSizeAnnotation = "hostpath/enforced-size"
+
+// The PV annotations recording the bind-ro backend's mount details
+const bindSourceAnnotation = "hostpath/bind-source"
+const readOnlyAnnotation = "hostpath/read-only"
+
+// The PV annotation recording which backend provisioned the volume, so Delete
+// knows how to clean it up
+const backendAnnotation = "hostpath/backend"
+
+// The PVC annotation used to request a specific backend for a single volume
+const pvcBackendAnnotation = "hostpath/backend"
+
+// A volumeBackend determines what's placed within a volume's directory, and how
+// it's released before the directory is removed
+type volumeBackend interface {
+	// Provision sets up the backend's storage within the (already-created)
+	// volume directory, returning any annotations to be recorded on the PV. It
+	// must be idempotent: when a provisioning operation is retried (possibly
+	// after the node's configuration changed), the directory may have already
+	// been partially set up, and must be brought up to the backend's current
+	// requirements rather than set up twice.
+	Provision(ctx context.Context, options controller.ProvisionOptions, finalPath string, permissions os.FileMode) (map[string]string, error)
+
+	// Release undoes whatever Provision did, leaving only the volume directory
+	// and its contents to be removed. It's used both when deleting volumes and
+	// when rolling back failed provisioning operations. It only gets the
+	// volume's path and the annotations Provision returned (as recorded on the
+	// PV), since the StorageClass may well have been deleted by the time its
+	// volumes are: anything Release needs to know must be found in either.
+	Release(ctx context.Context, fullPath string, annotations map[string]string) error
+}
+
+// All the backends known to this provisioner, though only those listed in
+// HOSTPATH_BACKENDS are available on any given node
+var knownBackends = map[string]volumeBackend{
+	directoryBackendName:    directoryBackend{},
+	tmpfsBackendName:        tmpfsBackend{},
+	bindReadOnlyBackendName: bindReadOnlyBackend{},
+	quotaBackendName:        &quotaBackend{},
+}
+
+// The access modes each backend can serve. Every backend's volumes are local
+// to one node, so the "many" modes only extend to the pods on that node.
+var backendAccessModes = map[string][]v1.PersistentVolumeAccessMode{
+	directoryBackendName:    {v1.ReadWriteOnce, v1.ReadWriteOncePod, v1.ReadWriteMany, v1.ReadOnlyMany},
+	tmpfsBackendName:        {v1.ReadWriteOnce, v1.ReadWriteOncePod, v1.ReadWriteMany},
+	bindReadOnlyBackendName: {v1.ReadOnlyMany},
+	quotaBackendName:        {v1.ReadWriteOnce, v1.ReadWriteOncePod, v1.ReadWriteMany, v1.ReadOnlyMany},
+}
+
+// checkAccessModes verifies that the named backend can serve all the access
+// modes requested by the PVC
+func checkAccessModes(backendName string, options controller.ProvisionOptions) error {
+	supported := backendAccessModes[backendName]
+	for _, mode := range options.PVC.Spec.AccessModes {
+		if !slices.Contains(supported, mode) {
+			return reject(rejectUnsupportedMode, fmt.Errorf("the %s backend only supports the access modes %v, but PVC %s/%s requested %s", backendName, supported, options.PVC.Namespace, options.PVC.Name, mode))
+		}
+	}
+	return nil
+}
+
+// directoryBackend is the original behavior: the volume is a plain directory
+type directoryBackend struct{}
+
+func (directoryBackend) Provision(ctx context.Context, options controller.ProvisionOptions, finalPath string, permissions os.FileMode) (map[string]string, error) {
+	// This may be pre-existing data that's mounted on purpose, so it's left alone
+	if existing, err := findMount(finalPath); err == nil && existing != nil {
+		klog.Warningf("\t[%s] is a %s mount point, which will be used as-is", finalPath, existing.FSType)
+	}
+	return nil, nil
+}
+
+func (directoryBackend) Release(ctx context.Context, fullPath string, annotations map[string]string) error {
+	return nil
+}
+
+// parseMetadataReserve parses the metadata reserve percentage from the given
+// StorageClass parameter value (blank = no reserve)
+func parseMetadataReserve(value string) (float64, error) {
+	if value == "" {
+		return 0, nil
+	}
+	reserve, err := strconv.ParseFloat(value, 64)
+	if err != nil || reserve < 0 || reserve > 100 {
+		return 0, fmt.Errorf("the %s parameter must be a percentage between 0 and 100, but it's [%s]", metadataReserveParameter, value)
+	}
+	return reserve, nil
+}
+
+// enforcedSize computes the size to enforce for the given requested size, so
+// the usable space still matches the request once the file system's metadata
+// has grown into the reserve
+func enforcedSize(requested int64, reserve float64) int64 {
+	return requested + int64(math.Ceil(float64(requested)*reserve/100))
+}
+
+// tmpfsBackend mounts a tmpfs sized after the PVC's request (plus the metadata
+// reserve, if any) at the volume directory, for scratch volumes which needn't
+// survive a reboot
+type tmpfsBackend struct{}
+
+func (tmpfsBackend) Provision(ctx context.Context, options controller.ProvisionOptions, finalPath string, permissions os.FileMode) (map[string]string, error) {
+	reserve, err := parseMetadataReserve(options.StorageClass.Parameters[metadataReserveParameter])
+	if err != nil {
+		return nil, reject(rejectInvalidParameter, fmt.Errorf("StorageClass %s is not valid: %w", options.StorageClass.Name, err))
+	}
+
+	var annotations map[string]string
+	data := fmt.Sprintf("mode=%04o", permissions.Perm())
+	if request, ok := options.PVC.Spec.Resources.Requests[v1.ResourceStorage]; ok && request.Value() > 0 {
+		size := enforcedSize(request.Value(), reserve)
+		data = fmt.Sprintf("%s,size=%d", data, size)
+		if size != request.Value() {
+			klog.Infof("\tReserving %g%% for metadata, the tmpfs at [%s] will hold %d bytes for a request of %d", reserve, finalPath, size, request.Value())
+			annotations = map[string]string{
+				enforcedSizeAnnotation: strconv.FormatInt(size, 10),
+			}
+		}
+	}
+	existing, err := findMount(finalPath)
+	if err != nil {
+		return nil, err
+	}
+	if existing != nil {
+		if existing.FSType != "tmpfs" {
+			return nil, fmt.Errorf("[%s] already has a %s file system mounted on it", finalPath, existing.FSType)
+		}
+		// A previous attempt already mounted it, so just apply the current settings
+		klog.Infof("\tA tmpfs is already mounted at [%s], updating it (%s)", finalPath, data)
+		return annotations, mount("tmpfs", finalPath, "tmpfs", syscall.MS_REMOUNT|syscall.MS_NOSUID|syscall.MS_NODEV, data)
+	}
+	if err := ensureEmpty(finalPath); err != nil {
+		return nil, err
+	}
+	klog.Infof("\tMounting a tmpfs at [%s] (%s)", finalPath, data)
+	return annotations, mount("tmpfs", finalPath, "tmpfs", syscall.MS_NOSUID|syscall.MS_NODEV, data)
+}
+
+func (tmpfsBackend) Release(ctx context.Context, fullPath string, annotations map[string]string) error {
+	klog.Infof("\tUnmounting the tmpfs at [%s]", fullPath)
+	if err := unmount(fullPath, 0); err != nil && err != syscall.EINVAL {
+		// EINVAL means it's not mounted, which is fine
+		return err
+	}
+	return nil
+}
+
+// bindReadOnlyBackend bind-mounts a shared source directory, read-only, at the
+// volume directory, so several ReadOnlyMany volumes may expose the same data.
+// The source is never removed: deleting the volume only removes the bind mount
+// and the (empty) mount point.
+type bindReadOnlyBackend struct{}
+
+func (bindReadOnlyBackend) Provision(ctx context.Context, options controller.ProvisionOptions, finalPath string, permissions os.FileMode) (map[string]string, error) {
+	source := options.StorageClass.Parameters[sourceParameter]
+	if source == "" || !filepath.IsAbs(source) {
+		return nil, reject(rejectInvalidParameter, fmt.Errorf("the %s backend requires StorageClass %s to have an absolute %s parameter, but it's [%s]", bindReadOnlyBackendName, options.StorageClass.Name, sourceParameter, source))
+	}
+	source = filepath.Clean(source)
+	info, err := os.Stat(source)
+	if err != nil {
+		return nil, fmt.Errorf("the shared source [%s] is not accessible: %w", source, err)
+	}
+	if !info.IsDir() {
+		return nil, fmt.Errorf("the shared source [%s] is not a directory", source)
+	}
+
+	existing, err := findMount(finalPath)
+	if err != nil {
+		return nil, err
+	}
+	if existing == nil {
+		if err := ensureEmpty(finalPath); err != nil {
+			return nil, err
+		}
+		klog.Infof("\tBind-mounting [%s] read-only at [%s]", source, finalPath)
+		if err := mount(source, finalPath, "", syscall.MS_BIND, ""); err != nil {
+			return nil, err
+		}
+	} else {
+		// A previous attempt may have mounted something else there (i.e. a tmpfs,
+		// or another source, before the StorageClass or the backend changed)
+		same, err := sameDirectory(finalPath, source)
+		if err != nil {
+			return nil, err
+		}
+		if !same {
+			return nil, fmt.Errorf("[%s] already has a %s file system from [%s] mounted on it, rather than a bind mount of [%s]", finalPath, existing.FSType, existing.Source, source)
+		}
+		if existing.readOnly() {
+			// A previous attempt already got this far
+			klog.Infof("\tThe read-only bind mount at [%s] is already in place", finalPath)
+			return map[string]string{
+				bindSourceAnnotation: source,
+				readOnlyAnnotation:   "true",
+			}, nil
+		}
+		klog.Infof("\tA previous attempt left [%s] mounted read-write, making it read-only", finalPath)
+	}
+	// The read-only flag is only honored for bind mounts on a remount
+	if err := mount("", finalPath, "", syscall.MS_BIND|syscall.MS_REMOUNT|syscall.MS_RDONLY|syscall.MS_NOSUID|syscall.MS_NODEV, ""); err != nil {
+		unmount(finalPath, 0)
+		return nil, err
+	}
+	return map[string]string{
+		bindSourceAnnotation: source,
+		readOnlyAnnotation:   "true",
+	}, nil
+}
+
+func (bindReadOnlyBackend) Release(ctx context.Context, fullPath string, annotations map[string]string) error {
+	klog.Infof("\tUnmounting the read-only bind mount at [%s]", fullPath)
+	if err := unmount(fullPath, 0); err != nil && err != syscall.EINVAL {
+		return err
+	}
+	// Make absolutely sure the shared source is no longer reachable through the
+	// volume's path before its contents are removed
+	mounted, err := isMountPoint(fullPath)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if mounted {
+		return fmt.Errorf("[%s] is still a mount point after unmounting the shared source", fullPath)
+	}
+	return nil
+}
+
+// ensureEmpty verifies that the given directory is empty, so mounting over it
+// won't hide any data
+func ensureEmpty(dir string) error {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	if len(entries) > 0 {
+		return fmt.Errorf("refusing to mount over the existing contents of [%s]", dir)
+	}
+	return nil
+}
+
+// parseBackends parses the comma-separated list of backends available on this
+// node, ignoring (with a warning) any unknown ones
+func parseBackends(value string) []string {
+	var result []string
+	for _, name := range strings.Split(value, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		if _, ok := knownBackends[name]; !ok {
+			klog.Warningf("Unknown backend [%s] in HOSTPATH_BACKENDS, ignoring it", name)
+			continue
+		}
+		result = append(result, name)
+	}
+	if len(result) == 0 {
+		result = []string{directoryBackendName}
+	}
+	return result
+}
+
+// backendAvailable returns true if the named backend is available on this node
+func (p *HostPathProvisioner) backendAvailable(name string) bool {
+	return slices.Contains(p.Backends, name)
+}
+
+// resolveBackend determines which backend to provision the volume with: the
+// PVC's override annotation if present (and allowed), or the one from the
+// StorageClass' profile
+func (p *HostPathProvisioner) resolveBackend(options controller.ProvisionOptions, profile volumeProfile) (string, error) {
+	name := profile.Backend
+	if !p.backendAvailable(name) {
+		return "", reject(rejectBackendUnavailable, fmt.Errorf("the backend [%s] configured for StorageClass %s is not available on this node (available: %s)", name, options.StorageClass.Name, strings.Join(p.Backends, ",")))
+	}
+	if p.AllowBackendOverride {
+		if override, ok := options.PVC.Annotations[p.PvcBackendAnnotation]; ok && override != "" {
+			if !p.backendAvailable(override) {
+				return "", reject(rejectBackendUnavailable, fmt.Errorf("the backend [%s] requested by PVC %s/%s is not available on this node (available: %s)", override, options.PVC.Namespace, options.PVC.Name, strings.Join(p.Backends, ",")))
+			}
+			klog.Infof("\tPVC %s/%s requested the [%s] backend", options.PVC.Namespace, options.PVC.Name, override)
+			name = override
+		}
+	}
+	return name, nil
+}
+
+// backend returns the named backend for a single provisioning operation, bound
+// to this provisioner if it needs to know about the provisioner's other volumes
+// (or to keep track of the operation, to roll it back)
+func (p *HostPathProvisioner) backend(name string) volumeBackend {
+	if name == quotaBackendName {
+		return &quotaBackend{ownedVolumes: p.listOwnedVolumes}
+	}
+	return knownBackends[name]
+}
+
+// volumeBackendFor finds the backend that provisioned the given PV from its
+// annotations alone, never from its (possibly deleted) StorageClass. Volumes
+// provisioned before backends were recorded are plain directories.
+func volumeBackendFor(volume *v1.PersistentVolume) (string, volumeBackend, error) {
+	name, ok := volume.Annotations[backendAnnotation]
+	if !ok || name == "" {
+		name = directoryBackendName
+	}
+	backend, ok := knownBackends[name]
+	if !ok {
+		return name, nil, fmt.Errorf("volume %s was provisioned with the unknown backend [%s]", volume.Name, name)
+	}
+	return name, backend, nil
+}
@@ -0,0 +1,542 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"os"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+
+	"sigs.k8s.io/sig-storage-lib-external-provisioner/v13/controller"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestResolveBackend(t *testing.T) {
+	tests := []struct {
+		name          string
+		allowOverride bool
+		override      string
+		expected      string
+		rejected      bool
+	}{
+		{name: "no override", allowOverride: true, expected: directoryBackendName},
+		{name: "valid override", allowOverride: true, override: tmpfsBackendName, expected: tmpfsBackendName},
+		{name: "unavailable override", allowOverride: true, override: bindReadOnlyBackendName, rejected: true},
+		{name: "unknown override", allowOverride: true, override: "zfs", rejected: true},
+		{name: "override not allowed", allowOverride: false, override: tmpfsBackendName, expected: directoryBackendName},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			p := newTestProvisioner(t)
+			p.Backends = []string{directoryBackendName, tmpfsBackendName}
+			p.AllowBackendOverride = test.allowOverride
+			var annotations map[string]string
+			if test.override != "" {
+				annotations = map[string]string{pvcBackendAnnotation: test.override}
+			}
+			options := testOptions("pv-override", testClaim("claim-override", annotations), testClass("standard", nil))
+			profile, err := p.resolveProfile(options)
+			if err != nil {
+				t.Fatalf("Failed to resolve the profile: %s", err)
+			}
+
+			name, err := p.resolveBackend(options, profile)
+			if test.rejected {
+				var rejected *rejection
+				if !errors.As(err, &rejected) || rejected.reason != rejectBackendUnavailable {
+					t.Errorf("Expected the override [%s] to be rejected, got %v", test.override, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Failed to resolve the backend: %s", err)
+			}
+			if name != test.expected {
+				t.Errorf("Expected the backend [%s], got [%s]", test.expected, name)
+			}
+		})
+	}
+}
+
+func TestBackendOverrideRecorded(t *testing.T) {
+	// The class says tmpfs, but the PVC overrides it with a plain directory,
+	// which must be what's recorded for the deletion
+	p := newTestProvisioner(t)
+	p.Backends = []string{directoryBackendName, tmpfsBackendName}
+	p.AllowBackendOverride = true
+	claim := testClaim("claim-recorded", map[string]string{pvcBackendAnnotation: directoryBackendName})
+	options := testOptions("pv-recorded", claim, testClass("scratch", map[string]string{backendParameter: tmpfsBackendName}))
+
+	volume, _, err := p.Provision(context.Background(), options)
+	if err != nil {
+		t.Fatalf("Failed to provision: %s", err)
+	}
+	if got := volume.Annotations[backendAnnotation]; got != directoryBackendName {
+		t.Errorf("Expected the backend [%s] to be recorded, got [%s]", directoryBackendName, got)
+	}
+	name, _, err := volumeBackendFor(volume)
+	if err != nil || name != directoryBackendName {
+		t.Errorf("Expected the deletion to use the [%s] backend, got [%s] (%v)", directoryBackendName, name, err)
+	}
+	if err := p.Delete(context.Background(), volume); err != nil {
+		t.Errorf("Failed to delete: %s", err)
+	}
+}
+
+// newBindReadOnlyTest sets up a provisioner with the bind-ro backend, a shared
+// source holding some data, and the options for a ReadOnlyMany volume of it
+func newBindReadOnlyTest(t *testing.T) (*HostPathProvisioner, *fakeMountTable, string, controller.ProvisionOptions) {
+	p := newTestProvisioner(t)
+	p.Backends = []string{bindReadOnlyBackendName}
+	p.DefaultBackend = bindReadOnlyBackendName
+	mounts := stubMountTable(t)
+	source := t.TempDir()
+	if err := os.WriteFile(path.Join(source, "shared"), []byte("shared data"), 0644); err != nil {
+		t.Fatalf("Failed to write the shared data: %s", err)
+	}
+	claim := testClaim("claim", nil)
+	claim.Spec.AccessModes = []v1.PersistentVolumeAccessMode{v1.ReadOnlyMany}
+	options := testOptions("pv", claim, testClass("shared", map[string]string{sourceParameter: source}))
+	return p, mounts, source, options
+}
+
+func TestBindReadOnly(t *testing.T) {
+	p, mounts, source, options := newBindReadOnlyTest(t)
+	volume, _, err := p.Provision(context.Background(), options)
+	if err != nil {
+		t.Fatalf("Provisioning failed: %s", err)
+	}
+	volumePath := path.Join(p.HostPathMount, "pv")
+
+	if volume.Annotations[bindSourceAnnotation] != source || volume.Annotations[readOnlyAnnotation] != "true" {
+		t.Errorf("The mount details weren't recorded: %v", volume.Annotations)
+	}
+	if len(mounts.mounts) != 2 {
+		t.Fatalf("Expected a bind mount and a read-only remount, got %+v", mounts.mounts)
+	}
+	if bind := mounts.mounts[0]; bind.source != source || bind.target != volumePath || bind.flags != syscall.MS_BIND {
+		t.Errorf("Unexpected bind mount: %+v", bind)
+	}
+	if remount := mounts.mounts[1]; remount.target != volumePath || remount.flags&(syscall.MS_BIND|syscall.MS_REMOUNT|syscall.MS_RDONLY) != syscall.MS_BIND|syscall.MS_REMOUNT|syscall.MS_RDONLY {
+		t.Errorf("Unexpected remount: %+v", remount)
+	}
+	if entry, err := findMount(volumePath); err != nil || entry == nil || !entry.readOnly() {
+		t.Errorf("Expected a read-only mount at [%s], got %+v (%v)", volumePath, entry, err)
+	}
+
+	if err := p.Delete(context.Background(), volume); err != nil {
+		t.Fatalf("Deletion failed: %s", err)
+	}
+	if !slices.Equal(mounts.unmounted, []string{volumePath}) {
+		t.Errorf("Expected only [%s] to be unmounted, got %v", volumePath, mounts.unmounted)
+	}
+	if _, err := os.Stat(volumePath); !os.IsNotExist(err) {
+		t.Errorf("The mount point wasn't removed: %v", err)
+	}
+	data, err := os.ReadFile(path.Join(source, "shared"))
+	if err != nil || string(data) != "shared data" {
+		t.Errorf("The shared source was altered by the deletion: [%s] (%v)", data, err)
+	}
+}
+
+func TestBindReadOnlyRetry(t *testing.T) {
+	for _, test := range []struct {
+		name     string
+		options  []string
+		remounts bool
+	}{
+		{name: "already read-only", options: []string{"ro"}},
+		{name: "left read-write", options: []string{"rw"}, remounts: true},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			p, mounts, source, options := newBindReadOnlyTest(t)
+			volumePath := path.Join(p.HostPathMount, "pv")
+			if err := os.Mkdir(volumePath, 0755); err != nil {
+				t.Fatalf("Failed to create the volume directory: %s", err)
+			}
+			mounts.add(mountEntry{MountPoint: volumePath, Options: test.options, FSType: "none", Source: source})
+
+			if _, _, err := p.Provision(context.Background(), options); err != nil {
+				t.Fatalf("Provisioning failed: %s", err)
+			}
+			if test.remounts {
+				if len(mounts.mounts) != 1 || mounts.mounts[0].flags&syscall.MS_REMOUNT == 0 {
+					t.Errorf("Expected only a read-only remount, got %+v", mounts.mounts)
+				}
+			} else if len(mounts.mounts) != 0 {
+				t.Errorf("Expected no mounts, got %+v", mounts.mounts)
+			}
+			if entry, err := findMount(volumePath); err != nil || entry == nil || !entry.readOnly() {
+				t.Errorf("Expected a read-only mount at [%s], got %+v (%v)", volumePath, entry, err)
+			}
+		})
+	}
+}
+
+func TestBindReadOnlyRetryMismatch(t *testing.T) {
+	for _, test := range []struct {
+		name  string
+		entry func(source string) mountEntry
+	}{
+		{
+			name: "tmpfs",
+			entry: func(source string) mountEntry {
+				return mountEntry{Options: []string{"rw"}, FSType: "tmpfs", Source: "tmpfs"}
+			},
+		},
+		{
+			name: "another source",
+			entry: func(source string) mountEntry {
+				return mountEntry{Options: []string{"ro"}, FSType: "none", Source: path.Join(path.Dir(source), "other")}
+			},
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			p, mounts, source, options := newBindReadOnlyTest(t)
+			volumePath := path.Join(p.HostPathMount, "pv")
+			if err := os.Mkdir(volumePath, 0755); err != nil {
+				t.Fatalf("Failed to create the volume directory: %s", err)
+			}
+			entry := test.entry(source)
+			entry.MountPoint = volumePath
+			mounts.add(entry)
+
+			if _, _, err := p.Provision(context.Background(), options); err == nil || !strings.Contains(err.Error(), "rather than a bind mount of ["+source+"]") {
+				t.Fatalf("Expected the provisioning to fail over the existing mount, got %v", err)
+			}
+			// What's mounted there is left as it was, rather than remounted
+			if len(mounts.mounts) != 0 {
+				t.Errorf("Expected no mounts, got %+v", mounts.mounts)
+			}
+			if current, err := findMount(volumePath); err != nil || current == nil || current.FSType != entry.FSType || current.Source != entry.Source || !slices.Equal(current.Options, entry.Options) {
+				t.Errorf("Expected [%s] to keep its mount %+v, got %+v (%v)", volumePath, entry, current, err)
+			}
+		})
+	}
+}
+
+func TestBindReadOnlyRemountFails(t *testing.T) {
+	p, mounts, _, options := newBindReadOnlyTest(t)
+	mounts.remountErr = syscall.EPERM
+	if _, _, err := p.Provision(context.Background(), options); !errors.Is(err, syscall.EPERM) {
+		t.Fatalf("Expected the provisioning to fail with the remount's error, got %v", err)
+	}
+	// The shared data must never be left exposed read-write
+	volumePath := path.Join(p.HostPathMount, "pv")
+	if entry, err := findMount(volumePath); err != nil || entry != nil {
+		t.Errorf("The read-write bind mount was left at [%s]: %+v (%v)", volumePath, entry, err)
+	}
+}
+
+func TestBindReadOnlyInvalidSource(t *testing.T) {
+	for name, source := range map[string]string{
+		"missing":  "",
+		"relative": "shared",
+	} {
+		t.Run(name, func(t *testing.T) {
+			p, mounts, _, options := newBindReadOnlyTest(t)
+			options.StorageClass.Parameters[sourceParameter] = source
+			_, _, err := p.Provision(context.Background(), options)
+			var rejected *rejection
+			if !errors.As(err, &rejected) || rejected.reason != rejectInvalidParameter {
+				t.Errorf("Expected the source [%s] to be rejected, got %v", source, err)
+			}
+			if len(mounts.mounts) != 0 {
+				t.Errorf("Expected no mounts, got %+v", mounts.mounts)
+			}
+		})
+	}
+}
+
+// newMetadataReserveTest sets up a provisioner with the given backend, and
+// returns a function reporting the size it enforced for the volume (or -1 if
+// it enforced none)
+func newMetadataReserveTest(t *testing.T, backendName string) (*HostPathProvisioner, func() int64) {
+	p := newTestProvisioner(t)
+	p.Backends = []string{backendName}
+	p.DefaultBackend = backendName
+	mounts := stubMountTable(t)
+	projects := stubProjects(t)
+	return p, func() int64 {
+		switch backendName {
+		case tmpfsBackendName:
+			if len(mounts.mounts) != 1 {
+				return -1
+			}
+			var mode int
+			var size int64
+			if _, err := fmt.Sscanf(mounts.mounts[0].data, "mode=%o,size=%d", &mode, &size); err != nil {
+				return -1
+			}
+			return size
+		default:
+			id := projects.ids[path.Join(p.HostPathMount, "pv")]
+			if size, ok := projects.limits[id]; ok && id != 0 {
+				return size
+			}
+			return -1
+		}
+	}
+}
+
+func TestMetadataReserve(t *testing.T) {
+	for _, backendName := range []string{tmpfsBackendName, quotaBackendName} {
+		for _, test := range []struct {
+			name     string
+			reserve  string
+			enforced int64
+		}{
+			{name: "no reserve", enforced: 1 << 30},
+			{name: "zero reserve", reserve: "0", enforced: 1 << 30},
+			{name: "ten percent", reserve: "10", enforced: 1<<30 + 107374183},
+			{name: "fractional", reserve: "2.5", enforced: 1<<30 + 26843546},
+		} {
+			t.Run(backendName+"/"+test.name, func(t *testing.T) {
+				p, enforced := newMetadataReserveTest(t, backendName)
+				parameters := map[string]string{}
+				if test.reserve != "" {
+					parameters[metadataReserveParameter] = test.reserve
+				}
+				claim := testClaim("claim", nil)
+
+				volume, _, err := p.Provision(context.Background(), testOptions("pv", claim, testClass("scratch", parameters)))
+				if err != nil {
+					t.Fatalf("Provisioning failed: %s", err)
+				}
+				if size := enforced(); size != test.enforced {
+					t.Errorf("Expected the %s backend to enforce %d bytes, got %d", backendName, test.enforced, size)
+				}
+
+				// The PV's capacity is what was requested, whatever's enforced
+				capacity := volume.Spec.Capacity[v1.ResourceStorage]
+				if requested := claim.Spec.Resources.Requests[v1.ResourceStorage]; capacity.Cmp(requested) != 0 {
+					t.Errorf("Expected the PV's capacity to be the request (%s), got %s", requested.String(), capacity.String())
+				}
+				annotation, ok := volume.Annotations[enforcedSizeAnnotation]
+				if test.enforced == 1<<30 {
+					if ok {
+						t.Errorf("Expected no enforced size annotation without a reserve, got [%s]", annotation)
+					}
+				} else if annotation != strconv.FormatInt(test.enforced, 10) {
+					t.Errorf("Expected the enforced size annotation [%d], got [%s]", test.enforced, annotation)
+				}
+			})
+		}
+	}
+}
+
+func TestInvalidMetadataReserve(t *testing.T) {
+	for _, backendName := range []string{tmpfsBackendName, quotaBackendName} {
+		for _, reserve := range []string{"-1", "101", "lots"} {
+			t.Run(backendName+"/"+reserve, func(t *testing.T) {
+				p, enforced := newMetadataReserveTest(t, backendName)
+				class := testClass("scratch", map[string]string{metadataReserveParameter: reserve})
+
+				_, _, err := p.Provision(context.Background(), testOptions("pv", testClaim("claim", nil), class))
+				var rejected *rejection
+				if !errors.As(err, &rejected) || rejected.reason != rejectInvalidParameter {
+					t.Errorf("Expected the reserve [%s] to be rejected, got %v", reserve, err)
+				}
+				if size := enforced(); size != -1 {
+					t.Errorf("Expected nothing to be enforced, got %d bytes", size)
+				}
+			})
+		}
+	}
+}
+
+func TestTmpfsRetryRemounts(t *testing.T) {
+	p := newTestProvisioner(t)
+	p.Backends = []string{tmpfsBackendName}
+	p.DefaultBackend = tmpfsBackendName
+	mounts := stubMountTable(t)
+	volumePath := path.Join(p.HostPathMount, "pv")
+	if err := os.Mkdir(volumePath, 0755); err != nil {
+		t.Fatalf("Failed to create the volume directory: %s", err)
+	}
+	mounts.add(mountEntry{MountPoint: volumePath, FSType: "tmpfs", Source: "tmpfs"})
+	class := testClass("scratch", map[string]string{metadataReserveParameter: "10"})
+
+	if _, _, err := p.Provision(context.Background(), testOptions("pv", testClaim("claim", nil), class)); err != nil {
+		t.Fatalf("Provisioning failed: %s", err)
+	}
+	if len(mounts.mounts) != 1 || mounts.mounts[0].flags&syscall.MS_REMOUNT == 0 || !strings.Contains(mounts.mounts[0].data, ",size=1181116007") {
+		t.Errorf("Expected the existing tmpfs to be remounted with the current size, got %+v", mounts.mounts)
+	}
+}
+
+func TestDeleteWithoutStorageClass(t *testing.T) {
+	for _, test := range []struct {
+		backend  string
+		class    map[string]string
+		accesses []v1.PersistentVolumeAccessMode
+		unmounts bool
+	}{
+		{backend: directoryBackendName},
+		{backend: tmpfsBackendName, class: map[string]string{metadataReserveParameter: "10"}, unmounts: true},
+		{backend: bindReadOnlyBackendName, accesses: []v1.PersistentVolumeAccessMode{v1.ReadOnlyMany}, unmounts: true},
+	} {
+		t.Run(test.backend, func(t *testing.T) {
+			source := t.TempDir()
+			parameters := map[string]string{backendParameter: test.backend, sourceParameter: source}
+			maps.Copy(parameters, test.class)
+			class := testClass("doomed", parameters)
+			p := newTestProvisioner(t, class)
+			p.Backends = []string{directoryBackendName, tmpfsBackendName, bindReadOnlyBackendName}
+			mounts := stubMountTable(t)
+			claim := testClaim("claim", nil)
+			if test.accesses != nil {
+				claim.Spec.AccessModes = test.accesses
+			}
+
+			volume, _, err := p.Provision(context.Background(), testOptions("pv", claim, class))
+			if err != nil {
+				t.Fatalf("Provisioning failed: %s", err)
+			}
+			if err := p.Client.StorageV1().StorageClasses().Delete(context.Background(), class.Name, metav1.DeleteOptions{}); err != nil {
+				t.Fatalf("Failed to delete the StorageClass: %s", err)
+			}
+			p.Client.(*fake.Clientset).ClearActions()
+
+			if err := p.Delete(context.Background(), volume); err != nil {
+				t.Fatalf("Deletion failed: %s", err)
+			}
+			volumePath := path.Join(p.HostPathMount, "pv")
+			if test.unmounts != (len(mounts.unmounted) == 1) {
+				t.Errorf("Expected the %s backend's cleanup (unmount = %t), got the unmounts %v", test.backend, test.unmounts, mounts.unmounted)
+			}
+			if _, err := os.Stat(volumePath); !os.IsNotExist(err) {
+				t.Errorf("The volume wasn't removed: %v", err)
+			}
+			if actions := p.Client.(*fake.Clientset).Actions(); len(actions) > 0 {
+				t.Errorf("The deletion made API calls: %v", actions)
+			}
+		})
+	}
+}
+
+func TestDeleteUnknownBackend(t *testing.T) {
+	p := newTestProvisioner(t)
+	volume := testVolume(t, p, "pv", "pv")
+	volume.Annotations[backendAnnotation] = "zfs"
+	if err := p.Delete(context.Background(), volume); err == nil || !strings.Contains(err.Error(), "unknown backend [zfs]") {
+		t.Errorf("Expected the deletion to fail for the unknown backend, got %v", err)
+	}
+	if _, err := os.Stat(path.Join(p.HostPathMount, "pv")); err != nil {
+		t.Errorf("The volume was removed without its backend's cleanup: %s", err)
+	}
+}
+
+func TestDeleteWithoutBackendAnnotation(t *testing.T) {
+	// Volumes provisioned before the backends existed are plain directories
+	p := newTestProvisioner(t)
+	volume := testVolume(t, p, "pv", "pv")
+	delete(volume.Annotations, backendAnnotation)
+	if err := p.Delete(context.Background(), volume); err != nil {
+		t.Fatalf("Deletion failed: %s", err)
+	}
+	if _, err := os.Stat(path.Join(p.HostPathMount, "pv")); !os.IsNotExist(err) {
+		t.Errorf("The volume wasn't removed: %v", err)
+	}
+}
+
+func TestCheckAccessModes(t *testing.T) {
+	modes := []v1.PersistentVolumeAccessMode{v1.ReadWriteOnce, v1.ReadWriteOncePod, v1.ReadWriteMany, v1.ReadOnlyMany}
+	allowed := map[string][]v1.PersistentVolumeAccessMode{
+		directoryBackendName:    modes,
+		tmpfsBackendName:        {v1.ReadWriteOnce, v1.ReadWriteOncePod, v1.ReadWriteMany},
+		bindReadOnlyBackendName: {v1.ReadOnlyMany},
+		quotaBackendName:        modes,
+	}
+	for _, backendName := range slices.Sorted(maps.Keys(knownBackends)) {
+		for _, mode := range modes {
+			t.Run(fmt.Sprintf("%s/%s", backendName, mode), func(t *testing.T) {
+				claim := testClaim("claim", nil)
+				claim.Spec.AccessModes = []v1.PersistentVolumeAccessMode{mode}
+				err := checkAccessModes(backendName, testOptions("pv", claim, testClass("standard", nil)))
+				if slices.Contains(allowed[backendName], mode) {
+					if err != nil {
+						t.Errorf("Expected %s to be allowed, got %s", mode, err)
+					}
+					return
+				}
+				var rejected *rejection
+				if !errors.As(err, &rejected) || rejected.reason != rejectUnsupportedMode {
+					t.Errorf("Expected %s to be rejected, got %v", mode, err)
+				}
+			})
+		}
+	}
+}
+
+func TestCheckAccessModesCombined(t *testing.T) {
+	// A single unsupported mode is enough to reject the PVC, and it's the one
+	// named in the error
+	claim := testClaim("claim", nil)
+	claim.Spec.AccessModes = []v1.PersistentVolumeAccessMode{v1.ReadWriteOnce, v1.ReadOnlyMany}
+	err := checkAccessModes(tmpfsBackendName, testOptions("pv", claim, testClass("scratch", nil)))
+	var rejected *rejection
+	if !errors.As(err, &rejected) || rejected.reason != rejectUnsupportedMode {
+		t.Fatalf("Expected the PVC to be rejected, got %v", err)
+	}
+	if !strings.HasSuffix(err.Error(), "requested "+string(v1.ReadOnlyMany)) {
+		t.Errorf("Expected the error to name %s, got [%s]", v1.ReadOnlyMany, err)
+	}
+
+	// No modes at all leaves nothing to reject
+	claim.Spec.AccessModes = nil
+	if err := checkAccessModes(bindReadOnlyBackendName, testOptions("pv", claim, testClass("shared", nil))); err != nil {
+		t.Errorf("Expected a PVC without access modes to be allowed, got %s", err)
+	}
+}
+
+func TestProvisionUnsupportedMode(t *testing.T) {
+	p := newTestProvisioner(t)
+	p.Backends = []string{directoryBackendName, tmpfsBackendName}
+	mounts := stubMountTable(t)
+	claim := testClaim("claim", nil)
+	claim.Spec.AccessModes = []v1.PersistentVolumeAccessMode{v1.ReadOnlyMany}
+	options := testOptions("pv", claim, testClass("scratch", map[string]string{backendParameter: tmpfsBackendName}))
+
+	_, state, err := p.Provision(context.Background(), options)
+	var rejected *rejection
+	if !errors.As(err, &rejected) || rejected.reason != rejectUnsupportedMode {
+		t.Fatalf("Expected the PVC to be rejected, got %v", err)
+	}
+	if state != controller.ProvisioningFinished {
+		t.Errorf("Expected the rejection to be final, got %s", state)
+	}
+
+	// It's rejected before anything's created or mounted
+	if len(mounts.mounts) != 0 {
+		t.Errorf("Expected nothing to be mounted, got %v", mounts.mounts)
+	}
+	if entries, err := os.ReadDir(p.HostPathMount); err != nil || len(entries) != 0 {
+		t.Errorf("Expected nothing to be created in [%s], got %v (%v)", p.HostPathMount, entries, err)
+	}
+}
@@ -0,0 +1,75 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"syscall"
+)
+
+var errOutOfSpace = errors.New("out of space")
+var errOutOfInodes = errors.New("out of inodes")
+
+// Reports a filesystem's free space (replaced by the tests, to simulate full
+// filesystems)
+var statfs = syscall.Statfs
+
+// checkCapacity verifies that the filesystem holding the given path has both
+// free bytes and free inodes left, since running out of either makes MkdirAll
+// fail with the same (confusing) ENOSPC. The returned error wraps errOutOfSpace
+// or errOutOfInodes accordingly.
+func checkCapacity(path string) error {
+	var stat syscall.Statfs_t
+	if err := statfs(path, &stat); err != nil {
+		return err
+	}
+	return capacityError(path, stat)
+}
+
+// nearestExistingDir finds the nearest ancestor of the given directory which
+// exists, since that's where its missing directories will be created. It's the
+// filesystem holding that one (i.e. a class subdirectory mounted on its own)
+// which must have room for them.
+func nearestExistingDir(dir string) string {
+	missing := missingDirs(dir)
+	if len(missing) == 0 {
+		return dir
+	}
+	return filepath.Dir(missing[len(missing)-1])
+}
+
+func capacityError(path string, stat syscall.Statfs_t) error {
+	if stat.Bavail == 0 {
+		return fmt.Errorf("the filesystem holding [%s] is %w (0 of %d blocks available)", path, errOutOfSpace, stat.Blocks)
+	}
+	// Some filesystems (i.e. btrfs) allocate inodes dynamically, and report
+	// zero total inodes
+	if stat.Files > 0 && stat.Ffree == 0 {
+		return fmt.Errorf("the filesystem holding [%s] is %w (0 of %d inodes free)", path, errOutOfInodes, stat.Files)
+	}
+	return nil
+}
+
+// capacityRejectionResource labels a capacity error for the metrics
+func capacityRejectionResource(err error) string {
+	if errors.Is(err, errOutOfInodes) {
+		return "inodes"
+	}
+	return "bytes"
+}
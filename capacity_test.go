@@ -0,0 +1,92 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path"
+	"syscall"
+	"testing"
+)
+
+func TestProvisionOutOfInodes(t *testing.T) {
+	// Plenty of free bytes, but no free inodes
+	stubStatfs(t, 1000, 0)
+	p := newTestProvisioner(t)
+	p.CapacityCheck = true
+
+	inodes := counterValue(t, capacityRejectionsTotal.WithLabelValues("inodes"))
+	bytes := counterValue(t, capacityRejectionsTotal.WithLabelValues("bytes"))
+	_, _, err := p.Provision(context.Background(), testOptions("pv-inodes", testClaim("claim-inodes", nil), testClass("standard", nil)))
+	if !errors.Is(err, errOutOfInodes) {
+		t.Fatalf("Expected an out of inodes rejection, got %v", err)
+	}
+	if errors.Is(err, errOutOfSpace) {
+		t.Errorf("The inode rejection was reported as out of space too: %s", err)
+	}
+	if got := counterValue(t, capacityRejectionsTotal.WithLabelValues("inodes")); got != inodes+1 {
+		t.Errorf("Expected the inodes rejection to be counted, got %v -> %v", inodes, got)
+	}
+	if got := counterValue(t, capacityRejectionsTotal.WithLabelValues("bytes")); got != bytes {
+		t.Errorf("The inodes rejection was counted as a bytes one, got %v -> %v", bytes, got)
+	}
+	if _, err := os.Stat(path.Join(p.PVDir, "pv-inodes")); !os.IsNotExist(err) {
+		t.Errorf("Expected no directory to be created, got %v", err)
+	}
+}
+
+func TestProvisionOutOfSpace(t *testing.T) {
+	stubStatfs(t, 0, 1000)
+	p := newTestProvisioner(t)
+	p.CapacityCheck = true
+
+	_, _, err := p.Provision(context.Background(), testOptions("pv-space", testClaim("claim-space", nil), testClass("standard", nil)))
+	if !errors.Is(err, errOutOfSpace) {
+		t.Fatalf("Expected an out of space rejection, got %v", err)
+	}
+}
+
+func TestCapacityCheckedOnNearestDir(t *testing.T) {
+	var checked []string
+	statfs = func(path string, stat *syscall.Statfs_t) error {
+		checked = append(checked, path)
+		*stat = syscall.Statfs_t{Bsize: 4096, Blocks: 1000, Bavail: 1000, Files: 1000, Ffree: 1000}
+		return nil
+	}
+	t.Cleanup(func() { statfs = syscall.Statfs })
+
+	p := newTestProvisioner(t)
+	p.CapacityCheck = true
+	p.StorageClassSubdirs = true
+
+	// Neither the class directory nor the volume's exist yet
+	if _, _, err := p.Provision(context.Background(), testOptions("pv-first", testClaim("claim-first", nil), testClass("gold", nil))); err != nil {
+		t.Fatalf("Failed to provision: %s", err)
+	}
+	// The class directory (which may be a mount of its own) exists now
+	claim := testClaim("claim-second", map[string]string{locationAnnotation: "team/data"})
+	if _, _, err := p.Provision(context.Background(), testOptions("pv-second", claim, testClass("gold", nil))); err != nil {
+		t.Fatalf("Failed to provision: %s", err)
+	}
+
+	expected := []string{p.PVDir, path.Join(p.PVDir, "gold")}
+	if len(checked) != len(expected) || checked[0] != expected[0] || checked[1] != expected[1] {
+		t.Errorf("Expected the capacity to be checked on %v, got %v", expected, checked)
+	}
+}
@@ -0,0 +1,161 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path"
+	"slices"
+	"strings"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	klog "k8s.io/klog/v2"
+)
+
+// The PV annotation holding the content hash of an adopted volume
+const contentHashAnnotation = "hostpath/content-hash"
+
+const contentHashPrefix = "sha256:"
+
+// Feed a length-prefixed value into the hash, so adjacent values can't be
+// shifted into each other to produce the same digest
+func hashField(h hash.Hash, value []byte) {
+	fmt.Fprintf(h, "%d:", len(value))
+	h.Write(value)
+}
+
+// hashTree computes a Merkle-style digest of the given path: each file's digest
+// covers its mode and contents, each symlink's covers its target, and each
+// directory's covers its entries' names and digests (in name order). Only the
+// permission bits are covered, and the entries with the names in skip are
+// ignored at the top level.
+func hashTree(root string, skip ...string) ([]byte, error) {
+	return hashEntry(root, skip)
+}
+
+func hashEntry(entryPath string, skip []string) ([]byte, error) {
+	info, err := os.Lstat(entryPath)
+	if err != nil {
+		return nil, err
+	}
+
+	h := sha256.New()
+	switch {
+	case info.Mode().IsRegular():
+		hashField(h, []byte("file"))
+		hashField(h, []byte(fmt.Sprintf("%04o", info.Mode().Perm())))
+		file, err := os.Open(entryPath)
+		if err != nil {
+			return nil, err
+		}
+		defer file.Close()
+		contents := sha256.New()
+		if _, err := io.Copy(contents, file); err != nil {
+			return nil, err
+		}
+		hashField(h, contents.Sum(nil))
+
+	case info.Mode()&os.ModeSymlink != 0:
+		target, err := os.Readlink(entryPath)
+		if err != nil {
+			return nil, err
+		}
+		hashField(h, []byte("symlink"))
+		hashField(h, []byte(target))
+
+	case info.IsDir():
+		hashField(h, []byte("dir"))
+		hashField(h, []byte(fmt.Sprintf("%04o", info.Mode().Perm())))
+		entries, err := os.ReadDir(entryPath)
+		if err != nil {
+			return nil, err
+		}
+		// ReadDir returns the entries sorted by name
+		for _, entry := range entries {
+			if slices.Contains(skip, entry.Name()) {
+				continue
+			}
+			digest, err := hashEntry(path.Join(entryPath, entry.Name()), nil)
+			if err != nil {
+				return nil, err
+			}
+			hashField(h, []byte(entry.Name()))
+			hashField(h, digest)
+		}
+
+	default:
+		// Devices, sockets and pipes have no contents worth hashing
+		hashField(h, []byte("special"))
+		hashField(h, []byte(info.Mode().Type().String()))
+	}
+	return h.Sum(nil), nil
+}
+
+// contentHash computes the value of the content hash annotation for the given
+// volume directory, ignoring its marker file (which records the annotation)
+func (p *HostPathProvisioner) contentHash(volumePath string) (string, error) {
+	digest, err := hashTree(volumePath, p.MarkerFile)
+	if err != nil {
+		return "", err
+	}
+	return contentHashPrefix + hex.EncodeToString(digest), nil
+}
+
+// verifyContentHash recomputes the content hash for the given volume directory,
+// and returns an error if it doesn't match the expected one
+func (p *HostPathProvisioner) verifyContentHash(volumePath string, expected string) error {
+	if !strings.HasPrefix(expected, contentHashPrefix) {
+		return fmt.Errorf("the content hash [%s] is not supported (must start with %s)", expected, contentHashPrefix)
+	}
+	actual, err := p.contentHash(volumePath)
+	if err != nil {
+		return err
+	}
+	if actual != expected {
+		return fmt.Errorf("the contents of [%s] have changed: expected %s, found %s", volumePath, expected, actual)
+	}
+	return nil
+}
+
+// verifyVolume implements the "verify <pv-name>" subcommand: it recomputes the
+// content hash of the named PV's directory and compares it against the one
+// recorded in its annotation
+func (p *HostPathProvisioner) verifyVolume(ctx context.Context, volumeName string) error {
+	volume, err := p.Client.CoreV1().PersistentVolumes().Get(ctx, volumeName, metav1.GetOptions{})
+	if err != nil {
+		return err
+	}
+	expected, ok := volume.Annotations[contentHashAnnotation]
+	if !ok {
+		return fmt.Errorf("volume %s has no %s annotation", volumeName, contentHashAnnotation)
+	}
+	volumePath, err := p.volumePath(volume)
+	if err != nil {
+		return err
+	}
+	if err := p.verifyContentHash(volumePath, expected); err != nil {
+		return err
+	}
+	klog.Infof("The contents of volume %s at [%s] match its content hash %s", volumeName, volumePath, expected)
+	return nil
+}
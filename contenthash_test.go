@@ -0,0 +1,140 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// writeTree populates the given directory with a small tree of files
+func writeTree(t *testing.T, root string) {
+	t.Helper()
+	files := map[string]string{
+		"a.txt":           "alpha",
+		"sub/b.txt":       "bravo",
+		"sub/deep/c.txt":  "charlie",
+		"sub/deep/d.conf": "",
+	}
+	for name, contents := range files {
+		filePath := path.Join(root, name)
+		if err := os.MkdirAll(path.Dir(filePath), 0755); err != nil {
+			t.Fatalf("Failed to create [%s]: %s", path.Dir(filePath), err)
+		}
+		if err := os.WriteFile(filePath, []byte(contents), 0644); err != nil {
+			t.Fatalf("Failed to write [%s]: %s", filePath, err)
+		}
+	}
+	if err := os.Symlink("sub/b.txt", path.Join(root, "link")); err != nil {
+		t.Fatalf("Failed to create the symlink: %s", err)
+	}
+}
+
+func TestContentHash(t *testing.T) {
+	p := newTestProvisioner(t)
+	p.MarkerFile = ".hostpath-marker"
+	first := path.Join(p.PVDir, "first")
+	second := path.Join(p.PVDir, "second")
+	writeTree(t, first)
+	writeTree(t, second)
+
+	hash, err := p.contentHash(first)
+	if err != nil {
+		t.Fatalf("Failed to hash [%s]: %s", first, err)
+	}
+	if !strings.HasPrefix(hash, contentHashPrefix) || len(hash) != len(contentHashPrefix)+64 {
+		t.Errorf("The content hash [%s] is malformed", hash)
+	}
+	if other, _ := p.contentHash(second); other != hash {
+		t.Errorf("Identical trees hashed differently: %s vs %s", hash, other)
+	}
+
+	// The marker records the hash, so it can't be covered by it
+	if err := os.WriteFile(path.Join(first, p.MarkerFile), []byte("marker"), 0644); err != nil {
+		t.Fatalf("Failed to write the marker: %s", err)
+	}
+	if other, _ := p.contentHash(first); other != hash {
+		t.Errorf("The marker file changed the content hash: %s vs %s", hash, other)
+	}
+
+	changes := map[string]func(root string) error{
+		"contents": func(root string) error {
+			return os.WriteFile(path.Join(root, "sub/deep/c.txt"), []byte("charlie!"), 0644)
+		},
+		"mode":     func(root string) error { return os.Chmod(path.Join(root, "a.txt"), 0600) },
+		"rename":   func(root string) error { return os.Rename(path.Join(root, "a.txt"), path.Join(root, "z.txt")) },
+		"new file": func(root string) error { return os.WriteFile(path.Join(root, "sub/new"), nil, 0644) },
+		"removal":  func(root string) error { return os.Remove(path.Join(root, "sub/deep/d.conf")) },
+		"symlink": func(root string) error {
+			os.Remove(path.Join(root, "link"))
+			return os.Symlink("a.txt", path.Join(root, "link"))
+		},
+	}
+	for name, change := range changes {
+		root := path.Join(p.PVDir, "changed-"+strings.ReplaceAll(name, " ", "-"))
+		writeTree(t, root)
+		if err := change(root); err != nil {
+			t.Fatalf("Failed to apply the %s change: %s", name, err)
+		}
+		if other, _ := p.contentHash(root); other == hash {
+			t.Errorf("The %s change didn't change the content hash", name)
+		}
+	}
+}
+
+func TestVerifyVolume(t *testing.T) {
+	p := newTestProvisioner(t)
+	p.ContentHash = true
+	p.MarkerFile = ".hostpath-marker"
+
+	// Adopt a directory that already has data in it
+	claim := testClaim("claim-adopted", map[string]string{locationAnnotation: "existing"})
+	writeTree(t, path.Join(p.PVDir, "existing"))
+	volume, _, err := p.Provision(context.Background(), testOptions("pv-adopted", claim, testClass("standard", nil)))
+	if err != nil {
+		t.Fatalf("Failed to provision: %s", err)
+	}
+	if _, ok := volume.Annotations[contentHashAnnotation]; !ok {
+		t.Fatalf("Expected the adopted volume to have a content hash")
+	}
+	if _, err := p.Client.CoreV1().PersistentVolumes().Create(context.Background(), volume, metav1.CreateOptions{}); err != nil {
+		t.Fatalf("Failed to create the PV: %s", err)
+	}
+
+	if err := p.verifyVolume(context.Background(), volume.Name); err != nil {
+		t.Errorf("Expected the untouched volume to verify, got %s", err)
+	}
+
+	if err := os.WriteFile(path.Join(p.PVDir, "existing", "sub", "b.txt"), []byte("tampered"), 0644); err != nil {
+		t.Fatalf("Failed to tamper with the volume: %s", err)
+	}
+	if err := p.verifyVolume(context.Background(), volume.Name); err == nil || !strings.Contains(err.Error(), "have changed") {
+		t.Errorf("Expected the tampered volume to fail verification, got %v", err)
+	}
+}
+
+func TestVerifyContentHashUnsupported(t *testing.T) {
+	p := newTestProvisioner(t)
+	if err := p.verifyContentHash(p.PVDir, "md5:0123"); err == nil {
+		t.Errorf("Expected an unsupported hash to fail verification")
+	}
+}
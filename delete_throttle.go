@@ -0,0 +1,117 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"time"
+
+	"golang.org/x/time/rate"
+	klog "k8s.io/klog/v2"
+)
+
+// The error returned when a throttled deletion is interrupted (i.e. its context
+// is cancelled) while waiting for its budget. The deletion is resumed when it's
+// retried, so this isn't fatal.
+var errDeleteInterrupted = errors.New("the deletion was interrupted while waiting for its budget")
+
+// newDeleteLimiter creates the limiter shared by all concurrent deletions, which
+// allows up to one second's worth of bytes to be removed in a single burst
+func newDeleteLimiter(bytesPerSecond int64) *rate.Limiter {
+	if bytesPerSecond <= 0 {
+		return nil
+	}
+	return rate.NewLimiter(rate.Limit(bytesPerSecond), int(bytesPerSecond))
+}
+
+// estimateSize adds up the sizes of all the regular files under the given
+// path. Symlinks aren't followed.
+func estimateSize(root string) (int64, error) {
+	var total int64
+	err := filepath.WalkDir(root, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if entry.Type().IsRegular() {
+			info, err := entry.Info()
+			if err != nil {
+				return err
+			}
+			total += info.Size()
+		}
+		return nil
+	})
+	return total, err
+}
+
+// waitForDeleteBudget blocks until the given number of bytes may be removed,
+// or the context is cancelled
+func (p *HostPathProvisioner) waitForDeleteBudget(ctx context.Context, size int64) error {
+	burst := int64(p.deleteLimiter.Burst())
+	for size > 0 {
+		n := min(size, burst)
+		if err := p.deleteLimiter.WaitN(ctx, int(n)); err != nil {
+			return fmt.Errorf("%w: %w", errDeleteInterrupted, err)
+		}
+		size -= n
+	}
+	return nil
+}
+
+// removeAll removes the given path and everything beneath it. If a deletion
+// budget is configured, the regular files are removed one by one, each waiting
+// for its size to fit within the budget, before the remaining (empty) directory
+// tree is removed.
+func (p *HostPathProvisioner) removeAll(ctx context.Context, root string) error {
+	if p.deleteLimiter == nil {
+		return os.RemoveAll(root)
+	}
+
+	size, err := estimateSize(root)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	klog.Infof("\tDeleting an estimated %d bytes at %d bytes per second (~%s)", size, p.DeleteBytesPerSecond, time.Duration(float64(size)/float64(p.DeleteBytesPerSecond)*float64(time.Second)).Round(time.Second))
+
+	err = filepath.WalkDir(root, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if entry.IsDir() {
+			return nil
+		}
+		if entry.Type().IsRegular() {
+			info, err := entry.Info()
+			if err != nil {
+				return err
+			}
+			if err := p.waitForDeleteBudget(ctx, info.Size()); err != nil {
+				return err
+			}
+		}
+		return os.Remove(path)
+	})
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return os.RemoveAll(root)
+}
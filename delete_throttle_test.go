@@ -0,0 +1,130 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+// writeFiles creates the given number of files of the given size in the
+// given directory
+func writeFiles(t *testing.T, dir string, count int, size int) {
+	t.Helper()
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatalf("Failed to create [%s]: %s", dir, err)
+	}
+	for i := range count {
+		if err := os.WriteFile(path.Join(dir, fmt.Sprintf("file-%d", i)), make([]byte, size), 0644); err != nil {
+			t.Fatalf("Failed to write the file: %s", err)
+		}
+	}
+}
+
+func newThrottledProvisioner(t *testing.T, bytesPerSecond int64) *HostPathProvisioner {
+	p := newTestProvisioner(t)
+	p.DeleteBytesPerSecond = bytesPerSecond
+	p.deleteLimiter = newDeleteLimiter(bytesPerSecond)
+	return p
+}
+
+func TestRemoveAllUnthrottled(t *testing.T) {
+	p := newTestProvisioner(t)
+	root := path.Join(p.PVDir, "volume")
+	writeFiles(t, path.Join(root, "nested"), 10, 10000)
+
+	start := time.Now()
+	if err := p.removeAll(context.Background(), root); err != nil {
+		t.Fatalf("Failed to remove [%s]: %s", root, err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("An unthrottled deletion took %s", elapsed)
+	}
+	if _, err := os.Stat(root); !os.IsNotExist(err) {
+		t.Errorf("Expected [%s] to be removed, got %v", root, err)
+	}
+}
+
+func TestRemoveAllThrottled(t *testing.T) {
+	// The first second's worth of bytes goes in a single burst, the remaining
+	// 15000 bytes should take ~1.5s
+	p := newThrottledProvisioner(t, 10000)
+	root := path.Join(p.PVDir, "volume")
+	writeFiles(t, root, 5, 2500)
+	writeFiles(t, path.Join(root, "nested"), 5, 2500)
+
+	start := time.Now()
+	if err := p.removeAll(context.Background(), root); err != nil {
+		t.Fatalf("Failed to remove [%s]: %s", root, err)
+	}
+	elapsed := time.Since(start)
+	if elapsed < 1200*time.Millisecond || elapsed > 5*time.Second {
+		t.Errorf("Expected the deletion to be paced to ~1.5s, but it took %s", elapsed)
+	}
+	if _, err := os.Stat(root); !os.IsNotExist(err) {
+		t.Errorf("Expected [%s] to be removed, got %v", root, err)
+	}
+}
+
+func TestRemoveAllThrottledLargeFile(t *testing.T) {
+	// Files larger than the burst are paid for in burst-sized installments
+	p := newThrottledProvisioner(t, 10000)
+	root := path.Join(p.PVDir, "volume")
+	writeFiles(t, root, 1, 25000)
+
+	start := time.Now()
+	if err := p.removeAll(context.Background(), root); err != nil {
+		t.Fatalf("Failed to remove [%s]: %s", root, err)
+	}
+	if elapsed := time.Since(start); elapsed < 1200*time.Millisecond {
+		t.Errorf("Expected the deletion to be paced to ~1.5s, but it took %s", elapsed)
+	}
+}
+
+func TestDeleteThrottledCancelled(t *testing.T) {
+	p := newThrottledProvisioner(t, 1000)
+	volume := testVolume(t, p, "pv-cancelled", "pv-cancelled")
+	volumePath, _ := p.volumePath(volume)
+	writeFiles(t, volumePath, 10, 1000)
+
+	// The delete must return the error rather than exit, and leave the rest to
+	// be removed when it's retried
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	err := p.delete(ctx, volume, newPhaseTimer())
+	if !errors.Is(err, errDeleteInterrupted) {
+		t.Fatalf("Expected the deletion to be interrupted, got %v", err)
+	}
+
+	deletePath := path.Join(p.PVDir, ".deleted.pv-cancelled."+string(volume.UID))
+	if _, err := os.Stat(deletePath); err != nil {
+		t.Fatalf("Expected the interrupted deletion to leave [%s] behind: %s", deletePath, err)
+	}
+
+	p.deleteLimiter = nil
+	if err := p.delete(context.Background(), volume, newPhaseTimer()); err != nil {
+		t.Fatalf("Failed to resume the deletion: %s", err)
+	}
+	if _, err := os.Stat(deletePath); !os.IsNotExist(err) {
+		t.Errorf("Expected the resumed deletion to remove [%s], got %v", deletePath, err)
+	}
+}
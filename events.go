@@ -0,0 +1,127 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	klog "k8s.io/klog/v2"
+)
+
+const eventProvisioned = "provisioned"
+const eventDeleted = "deleted"
+const eventFailed = "failed"
+
+// A lifecycle event, as streamed to the /events clients
+type lifecycleEvent struct {
+	Type      string    `json:"type"`
+	Operation string    `json:"operation"`
+	Volume    string    `json:"volume"`
+	Claim     string    `json:"claim,omitempty"`
+	Path      string    `json:"path,omitempty"`
+	Error     string    `json:"error,omitempty"`
+	Time      time.Time `json:"time"`
+}
+
+// eventBroker fans the lifecycle events out to all connected clients. Each
+// client has a bounded buffer, and events which don't fit are dropped for that
+// client rather than holding up the provisioner. All its methods are safe to
+// call on a nil instance, which does nothing.
+type eventBroker struct {
+	bufferSize  int
+	lock        sync.Mutex
+	subscribers map[chan lifecycleEvent]bool
+}
+
+func newEventBroker(bufferSize int) *eventBroker {
+	if bufferSize <= 0 {
+		return nil
+	}
+	return &eventBroker{
+		bufferSize:  bufferSize,
+		subscribers: map[chan lifecycleEvent]bool{},
+	}
+}
+
+func (b *eventBroker) subscribe() chan lifecycleEvent {
+	events := make(chan lifecycleEvent, b.bufferSize)
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.subscribers[events] = true
+	return events
+}
+
+func (b *eventBroker) unsubscribe(events chan lifecycleEvent) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	delete(b.subscribers, events)
+}
+
+func (b *eventBroker) publish(event lifecycleEvent) {
+	if b == nil {
+		return
+	}
+	event.Time = time.Now().UTC()
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	for events := range b.subscribers {
+		select {
+		case events <- event:
+		default:
+			eventsDroppedTotal.Inc()
+		}
+	}
+}
+
+// serveEvents handles /events, streaming the lifecycle events to the client
+// as server-sent events until it disconnects
+func (b *eventBroker) serveEvents(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming is not supported", http.StatusInternalServerError)
+		return
+	}
+
+	events := b.subscribe()
+	defer b.unsubscribe(events)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case event := <-events:
+			data, err := json.Marshal(event)
+			if err != nil {
+				klog.Warningf("Failed to marshal the lifecycle event: %s", err)
+				continue
+			}
+			if _, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event.Type, data); err != nil {
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}
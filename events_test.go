@@ -0,0 +1,130 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// readEvent reads the next server-sent event from the stream
+func readEvent(t *testing.T, scanner *bufio.Scanner) (string, lifecycleEvent) {
+	t.Helper()
+	var name string
+	var event lifecycleEvent
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case strings.HasPrefix(line, "event: "):
+			name = strings.TrimPrefix(line, "event: ")
+		case strings.HasPrefix(line, "data: "):
+			if err := json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &event); err != nil {
+				t.Fatalf("Failed to parse the event data [%s]: %s", line, err)
+			}
+		case line == "":
+			return name, event
+		}
+	}
+	t.Fatalf("The event stream ended: %v", scanner.Err())
+	return "", event
+}
+
+func TestEventsStream(t *testing.T) {
+	p := newTestProvisioner(t)
+	p.events = newEventBroker(10)
+	server := httptest.NewServer(http.HandlerFunc(p.events.serveEvents))
+	defer server.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	request, _ := http.NewRequestWithContext(ctx, http.MethodGet, server.URL, nil)
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		t.Fatalf("Failed to connect to the event stream: %s", err)
+	}
+	defer response.Body.Close()
+	if contentType := response.Header.Get("Content-Type"); contentType != "text/event-stream" {
+		t.Errorf("Expected a text/event-stream, got [%s]", contentType)
+	}
+
+	// The client is subscribed once the headers are in
+	volume, _, err := p.Provision(ctx, testOptions("pv-events", testClaim("claim-events", nil), testClass("standard", nil)))
+	if err != nil {
+		t.Fatalf("Failed to provision: %s", err)
+	}
+	claim := testClaim("claim-failed", map[string]string{locationAnnotation: "../outside"})
+	if _, _, err := p.Provision(ctx, testOptions("pv-failed", claim, testClass("standard", nil))); err == nil {
+		t.Fatalf("Expected the provisioning to fail")
+	}
+	if err := p.Delete(ctx, volume); err != nil {
+		t.Fatalf("Failed to delete: %s", err)
+	}
+
+	expected := []lifecycleEvent{
+		{Type: eventProvisioned, Operation: "provision", Volume: "pv-events", Claim: "default/claim-events", Path: volume.Spec.HostPath.Path},
+		{Type: eventFailed, Operation: "provision", Volume: "pv-failed", Claim: "default/claim-failed"},
+		{Type: eventDeleted, Operation: "delete", Volume: "pv-events", Claim: "", Path: volume.Spec.HostPath.Path},
+	}
+	scanner := bufio.NewScanner(response.Body)
+	for _, want := range expected {
+		name, got := readEvent(t, scanner)
+		if name != want.Type {
+			t.Errorf("Expected a %s event, got [%s]", want.Type, name)
+		}
+		if got.Type != want.Type || got.Operation != want.Operation || got.Volume != want.Volume || got.Claim != want.Claim || got.Path != want.Path {
+			t.Errorf("Expected the event %+v, got %+v", want, got)
+		}
+		if (want.Type == eventFailed) != (got.Error != "") {
+			t.Errorf("Expected only failures to carry an error, got %+v", got)
+		}
+		if got.Time.IsZero() {
+			t.Errorf("The event has no time: %+v", got)
+		}
+	}
+}
+
+func TestEventsSlowClient(t *testing.T) {
+	broker := newEventBroker(2)
+	slow := broker.subscribe()
+	defer broker.unsubscribe(slow)
+	fast := broker.subscribe()
+	defer broker.unsubscribe(fast)
+
+	before := counterValue(t, eventsDroppedTotal)
+	for range 5 {
+		broker.publish(lifecycleEvent{Type: eventProvisioned, Volume: "pv-slow"})
+		// Only the fast client keeps up
+		<-fast
+	}
+	if got := counterValue(t, eventsDroppedTotal); got != before+3 {
+		t.Errorf("Expected the 3 events which didn't fit the slow client's buffer to be dropped, got %v -> %v", before, got)
+	}
+	if len(slow) != 2 {
+		t.Errorf("Expected the slow client to have a full buffer, got %d events", len(slow))
+	}
+}
+
+func TestEventsDisabled(t *testing.T) {
+	var broker *eventBroker
+	broker.publish(lifecycleEvent{Type: eventProvisioned})
+}
@@ -25,10 +25,13 @@ import (
 	"path"
 	filepath "path/filepath"
 	"regexp"
+	"slices"
 	"strconv"
 	"strings"
 	"syscall"
+	"time"
 
+	"golang.org/x/time/rate"
 	yaml "gopkg.in/yaml.v3"
 
 	"sigs.k8s.io/sig-storage-lib-external-provisioner/v13/controller"
@@ -37,6 +40,8 @@ import (
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/util/retry"
 	klog "k8s.io/klog/v2"
 )
 
@@ -48,6 +53,82 @@ const pvcUidAnnotation = "hostpath/uid"
 const pvcGidAnnotation = "hostpath/gid"
 const pvcPermAnnotation = "hostpath/perm"
 
+// The PV annotation recording the workload which owns the PVC (i.e. "StatefulSet/web")
+const ownerAnnotation = "hostpath/owner"
+
+const modeMismatchWarn = "warn"
+const modeMismatchFail = "fail"
+
+// Fetch a string from the given environment variable, falling back to the
+// default value if it's not set
+func getEnvString(name string, def string) string {
+	value := os.Getenv(name)
+	if value == "" {
+		return def
+	}
+	return value
+}
+
+// Fetch a boolean (i.e. "true", "false", "1", "0") from the given environment
+// variable, falling back to the default value if it's not set or can't be parsed
+func getEnvBool(name string, def bool) bool {
+	value := os.Getenv(name)
+	if value == "" {
+		return def
+	}
+	parsed, err := strconv.ParseBool(value)
+	if err != nil {
+		klog.Warningf("The value [%s] for %s is not a valid boolean, will use the default [%t]: %s", value, name, def, err)
+		return def
+	}
+	return parsed
+}
+
+// Fetch a duration (i.e. "30s", "5m") from the given environment variable, falling
+// back to the default value if it's not set or can't be parsed
+func getEnvDuration(name string, def time.Duration) time.Duration {
+	value := os.Getenv(name)
+	if value == "" {
+		return def
+	}
+	parsed, err := time.ParseDuration(value)
+	if err != nil {
+		klog.Warningf("The value [%s] for %s is not a valid duration, will use the default [%s]: %s", value, name, def, err)
+		return def
+	}
+	return parsed
+}
+
+// Fetch a 64-bit integer from the given environment variable, falling back to
+// the default value if it's not set or can't be parsed
+func getEnvInt64(name string, def int64) int64 {
+	value := os.Getenv(name)
+	if value == "" {
+		return def
+	}
+	parsed, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		klog.Warningf("The value [%s] for %s is not a valid integer, will use the default [%d]: %s", value, name, def, err)
+		return def
+	}
+	return parsed
+}
+
+// Fetch an integer from the given environment variable, falling back to the
+// default value if it's not set or can't be parsed
+func getEnvInt(name string, def int) int {
+	value := os.Getenv(name)
+	if value == "" {
+		return def
+	}
+	parsed, err := strconv.Atoi(value)
+	if err != nil {
+		klog.Warningf("The value [%s] for %s is not a valid integer, will use the default [%d]: %s", value, name, def, err)
+		return def
+	}
+	return parsed
+}
+
 // Fetch provisioner name from environment variable HOSTPATH_PROVISIONER_NAME
 // if not set uses default hostpath name
 func GetProvisionerName() string {
@@ -91,12 +172,161 @@ type HostPathProvisioner struct {
 	// rwx-blabla string)
 	PvcPermAnnotation string
 
+	// The annotation name to look for within PVCs which contains the backend
+	// that should be used for the volume, instead of the default one
+	PvcBackendAnnotation string
+
 	// The directory at which the created volumes will be accessible to the pod
 	HostPathMount string
+
+	// The backends available on this node
+	Backends []string
+
+	// The backend used for volumes that don't request a specific one
+	DefaultBackend string
+
+	// Whether PVCs may request a specific backend via PvcBackendAnnotation
+	AllowBackendOverride bool
+
+	// The name of the marker file written into each volume's directory, which
+	// records the annotations placed on its PV (empty = no marker files)
+	MarkerFile string
+
+	// How often to compare each owned PV's annotations against the marker file
+	// in its directory (zero = never)
+	ReconcileInterval time.Duration
+
+	// What to do when the marker file and the PV annotations disagree: "none"
+	// only reports it, "marker" rewrites the PV annotations from the marker, and
+	// "annotations" rewrites the marker from the PV annotations
+	ReconcileRepair string
+
+	// What to do when the volume directory's actual mode doesn't match the requested
+	// one after it's been set: "warn" logs a warning, and "fail" fails the provisioning
+	ModeMismatch string
+
+	// The subtrees (relative to PVDir, so including the class subdirectory if
+	// StorageClassSubdirs is set) within which annotation-derived paths must
+	// fall (empty = anywhere)
+	AllowedSubtrees []string
+
+	// Whether each StorageClass's volumes should be placed within a subdirectory
+	// named after the class (i.e. ${PVDir}/${storageClassName}/${pvName})
+	StorageClassSubdirs bool
+
+	// Whether to compute a content hash for volumes whose directories already
+	// held data when they were provisioned (i.e. adopted or seeded data), and
+	// record it in a PV annotation so the data may be verified later
+	ContentHash bool
+
+	// Whether to verify that the filesystem has free bytes and inodes left before
+	// provisioning, to reject with a clear error instead of a confusing ENOSPC
+	CapacityCheck bool
+
+	// Whether to record the workload owning the PVC (from its owner references)
+	// in a PV annotation, for traceability
+	RecordOwner bool
+
+	// The file whose presence places the provisioner in maintenance, during which
+	// it's not ready and refuses to provision new volumes (empty = never)
+	MaintenanceFile string
+
+	// The port to serve /readyz (and /events and /debug/operations, if enabled)
+	// on, from startup and whether or not this replica is the leader (0 = none)
+	HTTPPort int
+
+	// Whether /readyz should report the individual readiness checks' results
+	ReadinessDetail bool
+
+	// Whether to keep a shared, watch-driven cache of the PVs (which is also used
+	// by the controller) rather than listing them all from the API when needed
+	VolumeCache bool
+
+	// How often the PV cache is resynchronized
+	VolumeCacheResync time.Duration
+
+	// What to do on startup when no StorageClass references this provisioner's
+	// name: "off" doesn't check, "warn" logs a warning, and "fatal" exits
+	StorageClassCheck string
+
+	// How many attempts may be made to update a PV when the updates conflict
+	// with other controllers'
+	UpdateRetries int
+
+	// What to do when a volume's path is still a mount point when it's deleted:
+	// "unmount" unmounts it first, "refuse" fails the deletion, and "ignore"
+	// removes it regardless
+	DeleteMount string
+
+	// Whether to undo the completed steps of a failed provisioning operation (i.e.
+	// unmount the backend, remove the directories created), in reverse order
+	RollbackOnFailure bool
+
+	// Whether to serve the in-flight operations at /debug/operations
+	DebugOperations bool
+
+	// The (octal) umask the directories are created with, before the explicit
+	// Chmod sets their requested mode
+	Umask int
+
+	// Whether to warn when the umask alters any of the configured modes
+	UmaskWarn bool
+
+	// Whether failed auxiliary API calls are errors, rather than warnings
+	StrictAuxiliary bool
+
+	// The delay between the starts of successive startup tasks (0 = none)
+	StartupStagger time.Duration
+
+	// The maximum random delay added to each startup task's start (0 = none)
+	StartupJitter time.Duration
+
+	// The file mapping StorageClasses to profiles of settings (empty = none)
+	ProfilesFile string
+
+	// The maximum number of bytes removed per second, across all concurrent
+	// deletions (zero = unlimited)
+	DeleteBytesPerSecond int64
+
+	// The client used to talk to the API server
+	Client kubernetes.Interface `yaml:"-"`
+
+	// The path of the node-local status file (empty = no status file)
+	StatusFile string
+
+	// How long a provisioning operation may take before it's reported as slow,
+	// with the breakdown of the time spent in each phase (zero = never)
+	SlowProvisionThreshold time.Duration
+
+	// Whether slow provisioning operations should also be reported via an event
+	// on the PVC
+	SlowProvisionEvent bool
+
+	// How many lifecycle events may be buffered for each /events client before
+	// they start being dropped (zero = no /events endpoint)
+	EventsBuffer int
+
+	// Paces the removals according to DeleteBytesPerSecond (nil = unlimited)
+	deleteLimiter *rate.Limiter
+
+	// Maintains the node-local status file (nil = no status file)
+	status *statusFile
+
+	// Fans the lifecycle events out to the /events clients (nil = no clients)
+	events *eventBroker
+
+	// The shared PV cache (nil = list the PVs from the API)
+	volumeInformer cache.SharedIndexInformer
+
+	// The profiles loaded from ProfilesFile (nil = none)
+	profiles *profileConfig
+
+	// Tracks the in-flight operations (nil = not tracked)
+	operations *operationTracker
 }
 
 // NewHostPathProvisioner creates a new hostpath provisioner
-func NewHostPathProvisioner() controller.Provisioner {
+func NewHostPathProvisioner(client kubernetes.Interface) *HostPathProvisioner {
 	nodeName := os.Getenv("NODE_NAME")
 	if nodeName == "" {
 		klog.Fatal("env variable NODE_NAME must be set so that this provisioner can identify itself")
@@ -138,6 +368,44 @@ func NewHostPathProvisioner() controller.Provisioner {
 		klog.Warningf("The given NODE_HOST_PATH_MOUNT value [%s] must be an absolute path", nodeHostPathMount)
 		nodeHostPathMount = "/hostPath"
 	}
+	markerFile := os.Getenv("HOSTPATH_MARKER_FILE")
+	if markerFile != "" && (strings.ContainsRune(markerFile, os.PathSeparator) || markerFile == "." || markerFile == "..") {
+		klog.Warningf("The given HOSTPATH_MARKER_FILE value [%s] must be a plain file name, marker files will be disabled", markerFile)
+		markerFile = ""
+	}
+	reconcileRepair := getEnvString("HOSTPATH_RECONCILE_REPAIR", reconcileRepairNone)
+	switch reconcileRepair {
+	case reconcileRepairNone, reconcileRepairFromMarker, reconcileRepairFromAnnotations:
+	default:
+		klog.Warningf("The given HOSTPATH_RECONCILE_REPAIR value [%s] is not valid, will only report discrepancies", reconcileRepair)
+		reconcileRepair = reconcileRepairNone
+	}
+	nodePvcBackendAnnotation := getEnvString("NODE_PVC_BACKEND_ANNOTATION", pvcBackendAnnotation)
+	availableBackends := parseBackends(os.Getenv("HOSTPATH_BACKENDS"))
+	defaultBackend := getEnvString("HOSTPATH_DEFAULT_BACKEND", availableBackends[0])
+	if !slices.Contains(availableBackends, defaultBackend) {
+		klog.Warningf("The given HOSTPATH_DEFAULT_BACKEND value [%s] is not among the available backends %v, will use [%s]", defaultBackend, availableBackends, availableBackends[0])
+		defaultBackend = availableBackends[0]
+	}
+	modeMismatch := getEnvString("HOSTPATH_MODE_MISMATCH", modeMismatchWarn)
+	if modeMismatch != modeMismatchWarn && modeMismatch != modeMismatchFail {
+		klog.Warningf("The given HOSTPATH_MODE_MISMATCH value [%s] is not valid, will use [%s]", modeMismatch, modeMismatchWarn)
+		modeMismatch = modeMismatchWarn
+	}
+	deleteMount := getEnvString("HOSTPATH_DELETE_MOUNT", deleteMountUnmount)
+	switch deleteMount {
+	case deleteMountUnmount, deleteMountRefuse, deleteMountIgnore:
+	default:
+		klog.Warningf("The given HOSTPATH_DELETE_MOUNT value [%s] is not valid, will use [%s]", deleteMount, deleteMountUnmount)
+		deleteMount = deleteMountUnmount
+	}
+	storageClassCheck := getEnvString("HOSTPATH_STORAGE_CLASS_CHECK", storageClassCheckOff)
+	switch storageClassCheck {
+	case storageClassCheckOff, storageClassCheckWarn, storageClassCheckFatal:
+	default:
+		klog.Warningf("The given HOSTPATH_STORAGE_CLASS_CHECK value [%s] is not valid, will use [%s]", storageClassCheck, storageClassCheckOff)
+		storageClassCheck = storageClassCheckOff
+	}
 	result := HostPathProvisioner{
 		PVDir:                  nodeHostPath,
 		Identity:               nodeName,
@@ -148,6 +416,59 @@ func NewHostPathProvisioner() controller.Provisioner {
 		PvcUidAnnotation:       nodePvcUidAnnotation,
 		PvcGidAnnotation:       nodePvcGidAnnotation,
 		PvcPermAnnotation:      nodePvcPermAnnotation,
+		PvcBackendAnnotation:   nodePvcBackendAnnotation,
+		Backends:               availableBackends,
+		DefaultBackend:         defaultBackend,
+		AllowBackendOverride:   getEnvBool("HOSTPATH_ALLOW_BACKEND_OVERRIDE", false),
+		MarkerFile:             markerFile,
+		ReconcileInterval:      getEnvDuration("HOSTPATH_RECONCILE_INTERVAL", 0),
+		ReconcileRepair:        reconcileRepair,
+		ModeMismatch:           modeMismatch,
+		AllowedSubtrees:        parseSubtrees(os.Getenv("HOSTPATH_ALLOWED_SUBTREES")),
+		StorageClassSubdirs:    getEnvBool("HOSTPATH_STORAGE_CLASS_SUBDIRS", false),
+		ContentHash:            getEnvBool("HOSTPATH_CONTENT_HASH", false),
+		CapacityCheck:          getEnvBool("HOSTPATH_CAPACITY_CHECK", false),
+		RecordOwner:            getEnvBool("HOSTPATH_RECORD_OWNER", false),
+		MaintenanceFile:        os.Getenv("HOSTPATH_MAINTENANCE_FILE"),
+		HTTPPort:               getEnvInt("HOSTPATH_HTTP_PORT", 0),
+		ReadinessDetail:        getEnvBool("HOSTPATH_READINESS_DETAIL", false),
+		VolumeCache:            getEnvBool("HOSTPATH_VOLUME_CACHE", false),
+		VolumeCacheResync:      getEnvDuration("HOSTPATH_VOLUME_CACHE_RESYNC", 15*time.Minute),
+		StorageClassCheck:      storageClassCheck,
+		UpdateRetries:          getEnvInt("HOSTPATH_UPDATE_RETRIES", retry.DefaultRetry.Steps),
+		DeleteMount:            deleteMount,
+		RollbackOnFailure:      getEnvBool("HOSTPATH_ROLLBACK_ON_FAILURE", true),
+		DebugOperations:        getEnvBool("HOSTPATH_DEBUG_OPERATIONS", false),
+		Umask:                  parseUmask(os.Getenv("HOSTPATH_UMASK")),
+		UmaskWarn:              getEnvBool("HOSTPATH_UMASK_WARN", false),
+		StrictAuxiliary:        getEnvBool("HOSTPATH_STRICT_AUXILIARY", false),
+		StartupStagger:         getEnvDuration("HOSTPATH_STARTUP_STAGGER", 0),
+		StartupJitter:          getEnvDuration("HOSTPATH_STARTUP_JITTER", 0),
+		ProfilesFile:           os.Getenv("HOSTPATH_PROFILES_FILE"),
+		DeleteBytesPerSecond:   getEnvInt64("HOSTPATH_DELETE_BYTES_PER_SECOND", 0),
+		StatusFile:             os.Getenv("HOSTPATH_STATUS_FILE"),
+		SlowProvisionThreshold: getEnvDuration("HOSTPATH_SLOW_PROVISION_THRESHOLD", 0),
+		SlowProvisionEvent:     getEnvBool("HOSTPATH_SLOW_PROVISION_EVENT", false),
+		EventsBuffer:           getEnvInt("HOSTPATH_EVENTS_BUFFER", 0),
+		Client:                 client,
+	}
+	result.deleteLimiter = newDeleteLimiter(result.DeleteBytesPerSecond)
+	result.status = newStatusFile(result.StatusFile, result.DefaultBackend)
+	result.events = newEventBroker(result.EventsBuffer)
+	result.operations = newOperationTracker(result.DebugOperations)
+	if result.ProfilesFile != "" {
+		profiles, err := loadProfiles(result.ProfilesFile)
+		if err != nil {
+			klog.Fatalf("Failed to load the profiles from [%s]: %s", result.ProfilesFile, err)
+		}
+		result.profiles = profiles
+	}
+	if result.VolumeCache && client != nil {
+		informer, err := newVolumeInformer(client, result.VolumeCacheResync)
+		if err != nil {
+			klog.Fatalf("Failed to create the PV cache: %s", err)
+		}
+		result.volumeInformer = informer
 	}
 	yamlData, err := yaml.Marshal(result)
 	if err == nil {
@@ -160,6 +481,46 @@ func NewHostPathProvisioner() controller.Provisioner {
 
 var _ controller.Provisioner = &HostPathProvisioner{}
 
+var unsafeDirNameChars = regexp.MustCompile(`[^A-Za-z0-9._-]`)
+
+// Sets the volume directories' modes (replaced by the tests, to simulate
+// filesystems which don't honor them)
+var chmod = os.Chmod
+
+// parseSubtrees parses the comma-separated list of allowed subtrees, normalizing
+// them into clean relative paths
+func parseSubtrees(value string) []string {
+	var result []string
+	for _, subtree := range strings.Split(value, ",") {
+		if strings.TrimSpace(subtree) == "" {
+			continue
+		}
+		subtree = strings.Trim(filepath.Clean("/"+strings.TrimSpace(subtree)), string(os.PathSeparator))
+		if subtree == "" {
+			klog.Warningf("HOSTPATH_ALLOWED_SUBTREES may not contain the root directory itself, ignoring that entry")
+			continue
+		}
+		result = append(result, subtree)
+	}
+	return result
+}
+
+// withinSubtree returns true if the given relative path is the given subtree,
+// or lies beneath it
+func withinSubtree(relativePath string, subtree string) bool {
+	return relativePath == subtree || strings.HasPrefix(relativePath, subtree+string(os.PathSeparator))
+}
+
+// sanitizeDirName renders the given name safe for use as a single directory
+// name, replacing any questionable characters with underscores
+func sanitizeDirName(name string) string {
+	name = unsafeDirNameChars.ReplaceAllString(name, "_")
+	if name == "" || name == "." || name == ".." {
+		name = strings.Repeat("_", max(len(name), 1))
+	}
+	return name
+}
+
 func (p *HostPathProvisioner) parseId(options controller.ProvisionOptions, annotation string) (int64, error) {
 	id, ok := options.PVC.Annotations[annotation]
 	if ok {
@@ -198,9 +559,102 @@ func (p *HostPathProvisioner) applyPermissions(options controller.ProvisionOptio
 	return nil
 }
 
+// applyMode explicitly sets the requested mode on the volume's directory (since
+// MkdirAll leaves existing directories alone), then verifies that the filesystem
+// actually honored it, as some (i.e. network filesystems) silently won't
+func (p *HostPathProvisioner) applyMode(finalPath string, permissions os.FileMode) error {
+	if err := chmod(finalPath, permissions); err != nil {
+		klog.Warningf("\tFailed to set the mode %04o on [%s]: %s", permissions.Perm(), finalPath, err)
+	}
+
+	info, err := os.Stat(finalPath)
+	if err != nil {
+		klog.Errorf("\tFailed to stat [%s] to verify its mode: %s", finalPath, err)
+		return err
+	}
+
+	actual := info.Mode().Perm()
+	if actual == permissions.Perm() {
+		return nil
+	}
+
+	err = fmt.Errorf("the filesystem did not honor the mode for [%s]: requested %04o, actual %04o", finalPath, permissions.Perm(), actual)
+	if p.ModeMismatch == modeMismatchFail {
+		klog.Errorf("\tProvisioning failed: %s", err)
+		return err
+	}
+	klog.Warningf("\t%s", err)
+	return nil
+}
+
+// claimOwner describes the workload which owns the given PVC, preferring its
+// controller over any other owners. Returns an empty string if it has no owners.
+func claimOwner(claim *v1.PersistentVolumeClaim) string {
+	owners := claim.OwnerReferences
+	if len(owners) == 0 {
+		return ""
+	}
+	owner := owners[0]
+	for _, ref := range owners {
+		if ref.Controller != nil && *ref.Controller {
+			owner = ref
+			break
+		}
+	}
+	return owner.Kind + "/" + owner.Name
+}
+
 // Provision creates a storage asset and returns a PV object representing it.
 func (p *HostPathProvisioner) Provision(ctx context.Context, options controller.ProvisionOptions) (*v1.PersistentVolume, controller.ProvisioningState, error) {
+	timer := newPhaseTimer()
+	defer p.operations.start("provision", options.PVName, options.PVC.Namespace+"/"+options.PVC.Name, timer)()
+	undo := &rollback{}
+	pv, state, err := p.provision(ctx, options, timer, undo)
+	countRejection(err)
+	if latencyErr := p.checkProvisionLatency(ctx, options, timer); latencyErr != nil && err == nil {
+		klog.Errorf("\tProvisioning failed: %s", latencyErr)
+		pv, err = nil, latencyErr
+	}
+	if err != nil && p.RollbackOnFailure {
+		klog.Infof("\tRolling back the failed provisioning of volume %s", options.PVName)
+		undo.run()
+	}
+	claim := options.PVC.Namespace + "/" + options.PVC.Name
+	if err != nil {
+		p.status.failed(err)
+		p.events.publish(lifecycleEvent{Type: eventFailed, Operation: "provision", Volume: options.PVName, Claim: claim, Error: err.Error()})
+	} else {
+		p.status.provisioned(pv)
+		p.events.publish(lifecycleEvent{Type: eventProvisioned, Operation: "provision", Volume: pv.Name, Claim: claim, Path: pv.Spec.HostPath.Path})
+	}
+	return pv, state, err
+}
+
+func (p *HostPathProvisioner) provision(ctx context.Context, options controller.ProvisionOptions, timer *phaseTimer, undo *rollback) (*v1.PersistentVolume, controller.ProvisioningState, error) {
+	if p.inMaintenance() {
+		return nil, controller.ProvisioningNoChange, fmt.Errorf("the provisioner is in maintenance (the file [%s] is present)", p.MaintenanceFile)
+	}
+
+	profile, err := p.resolveProfile(options)
+	if err != nil {
+		klog.Errorf("Provisioning failed for PVC %s/%s: %s", options.PVC.Namespace, options.PVC.Name, err)
+		return nil, controller.ProvisioningFinished, err
+	}
+
+	backendName, err := p.resolveBackend(options, profile)
+	if err != nil {
+		klog.Errorf("Provisioning failed for PVC %s/%s: %s", options.PVC.Namespace, options.PVC.Name, err)
+		return nil, controller.ProvisioningFinished, err
+	}
+	backend := p.backend(backendName)
+
+	if err := checkAccessModes(backendName, options); err != nil {
+		klog.Errorf("Provisioning rejected for PVC %s/%s: %s", options.PVC.Namespace, options.PVC.Name, err)
+		return nil, controller.ProvisioningFinished, err
+	}
+
 	relativePath := options.PVName
+	fromAnnotation := false
 
 	// Allow the use of an annotation to request a specific location within the
 	// directory hierarchy. If the annotation isn't present, the original behavior
@@ -255,14 +709,54 @@ func (p *HostPathProvisioner) Provision(ctx context.Context, options controller.
 		if (customPath != ".") && (customPath != "") {
 			relativePath = customPath
 		}
+		fromAnnotation = true
 	} else {
 		klog.Infof("No %s annotation for PVC %s/%s, will use the default path: [%s]", p.LocationAnnotation, options.PVC.Namespace, options.PVC.Name, relativePath)
 	}
+
+	// Never let the annotation-derived paths escape the volumes' directory (or
+	// their class' directory, below), nor name that directory itself
+	if fromAnnotation {
+		cleanPath := strings.Trim(filepath.Clean(relativePath), string(os.PathSeparator))
+		if cleanPath == "" || cleanPath == "." || cleanPath == ".." || strings.HasPrefix(cleanPath, ".."+string(os.PathSeparator)) {
+			err := reject(rejectPathTraversal, fmt.Errorf("the path [%s] requested by PVC %s/%s doesn't lie within [%s]", relativePath, options.PVC.Namespace, options.PVC.Name, p.PVDir))
+			klog.Errorf("\tProvisioning rejected: %s", err)
+			return nil, controller.ProvisioningFinished, err
+		}
+	}
+
+	// Group the volumes by StorageClass, if so configured. The full path is stored
+	// in the PV, so Delete needn't know about this.
+	if p.StorageClassSubdirs {
+		classDir := sanitizeDirName(options.StorageClass.Name)
+		klog.Infof("\tPlacing the volume within the directory [%s] for StorageClass %s", classDir, options.StorageClass.Name)
+		relativePath = path.Join(classDir, relativePath)
+		if !strings.HasPrefix(relativePath, classDir+string(os.PathSeparator)) {
+			err := reject(rejectPathTraversal, fmt.Errorf("the path [%s] for PVC %s/%s doesn't lie within the directory [%s] for StorageClass %s", relativePath, options.PVC.Namespace, options.PVC.Name, classDir, options.StorageClass.Name))
+			klog.Errorf("\tProvisioning rejected: %s", err)
+			return nil, controller.ProvisioningFinished, err
+		}
+	}
+
+	// Restrict the annotation-derived paths to the allowed subtrees, if any
+	if fromAnnotation && len(p.AllowedSubtrees) > 0 {
+		cleanPath := filepath.Clean(relativePath)
+		if !slices.ContainsFunc(p.AllowedSubtrees, func(subtree string) bool { return withinSubtree(cleanPath, subtree) }) {
+			err := reject(rejectPathNotAllowed, fmt.Errorf("the path [%s] requested by PVC %s/%s is not within any of the allowed subtrees %v", relativePath, options.PVC.Namespace, options.PVC.Name, p.AllowedSubtrees))
+			klog.Errorf("\tProvisioning rejected: %s", err)
+			return nil, controller.ProvisioningFinished, err
+		}
+	}
 	hostPath := path.Join(p.PVDir, relativePath)
 	volumeName := options.PVName
 
-	// Default permissions
-	permissions := os.FileMode.Perm(0755)
+	// Default permissions, unless the StorageClass' profile says otherwise (it's
+	// already been validated)
+	permissions := defaultPermissions
+	if profile.Perm != "" {
+		parsedPermissions, _ := strconv.ParseUint(profile.Perm, 8, 32)
+		permissions = os.FileMode(parsedPermissions)
+	}
 
 	pvcPermissions, permissionsOk := options.PVC.Annotations[p.PvcPermAnnotation]
 	if permissionsOk && pvcPermissions != "" {
@@ -279,19 +773,62 @@ func (p *HostPathProvisioner) Provision(ctx context.Context, options controller.
 	finalPath := path.Join(p.HostPathMount, relativePath)
 
 	klog.Infof("Provisioning volume %s from PVC %s/%s at host path [%s]", volumeName, options.PVC.Namespace, options.PVC.Name, hostPath)
-	if err := os.MkdirAll(finalPath, permissions); err != nil {
-		klog.Fatalf("\tProvisioning failed: %s", err)
-		return nil, controller.ProvisioningFinished, err
+	_, statErr := os.Stat(finalPath)
+	adopted := statErr == nil
+	if p.CapacityCheck && !adopted {
+		if err := checkCapacity(nearestExistingDir(finalPath)); err != nil {
+			if errors.Is(err, errOutOfSpace) || errors.Is(err, errOutOfInodes) {
+				capacityRejectionsTotal.WithLabelValues(capacityRejectionResource(err)).Inc()
+			}
+			klog.Errorf("\tProvisioning rejected: %s", err)
+			return nil, controller.ProvisioningFinished, err
+		}
 	}
+	timer.mark("validate")
 
+	createdDirs := missingDirs(finalPath)
 	if err := os.MkdirAll(finalPath, permissions); err != nil {
 		klog.Fatalf("\tProvisioning failed: %s", err)
 		return nil, controller.ProvisioningFinished, err
 	}
+	undo.add("mkdir", func() error { return removeDirs(createdDirs) })
+	timer.mark("mkdir")
+
+	// A marker left behind by a previous attempt will be rewritten at the end,
+	// and mustn't keep a backend from mounting over the directory. Directories
+	// with anything else in them are left for the backend to deal with.
+	if adopted && p.MarkerFile != "" && backendName != directoryBackendName {
+		if entries, err := os.ReadDir(finalPath); err == nil && len(entries) == 1 && entries[0].Name() == p.MarkerFile {
+			if err := os.Remove(path.Join(finalPath, p.MarkerFile)); err == nil {
+				klog.Infof("\tRemoved the marker left behind by a previous attempt at [%s]", finalPath)
+			}
+		}
+	}
 
-	if err := p.applyPermissions(options, finalPath); err != nil {
+	backendAnnotations, err := backend.Provision(ctx, options, finalPath, permissions)
+	if err != nil {
+		klog.Errorf("\tProvisioning with the [%s] backend failed: %s", backendName, err)
 		return nil, controller.ProvisioningFinished, err
 	}
+	undo.add(backendName, func() error { return backend.Release(ctx, finalPath, backendAnnotations) })
+	timer.mark("backend")
+
+	// Read-only volumes expose shared data whose mode and ownership (and contents)
+	// aren't ours to change
+	readOnly := backendAnnotations[readOnlyAnnotation] == "true"
+	if readOnly {
+		klog.Infof("\tThe volume is read-only, leaving the mode and ownership of [%s] alone", finalPath)
+	} else {
+		if err := p.applyMode(finalPath, permissions); err != nil {
+			return nil, controller.ProvisioningFinished, err
+		}
+		timer.mark("chmod")
+
+		if err := p.applyPermissions(options, finalPath); err != nil {
+			return nil, controller.ProvisioningFinished, err
+		}
+		timer.mark("chown")
+	}
 
 	volumeType := v1.HostPathDirectoryOrCreate
 	pv := &v1.PersistentVolume{
@@ -299,6 +836,7 @@ func (p *HostPathProvisioner) Provision(ctx context.Context, options controller.
 			Name: volumeName,
 			Annotations: map[string]string{
 				provisionerIdentityAnnotation: p.Identity,
+				backendAnnotation:             backendName,
 			},
 		},
 		Spec: v1.PersistentVolumeSpec{
@@ -316,13 +854,79 @@ func (p *HostPathProvisioner) Provision(ctx context.Context, options controller.
 		},
 	}
 
+	for key, value := range backendAnnotations {
+		pv.Annotations[key] = value
+	}
+
+	if p.RecordOwner {
+		if owner := claimOwner(options.PVC); owner != "" {
+			klog.Infof("\tPVC %s/%s is owned by %s", options.PVC.Namespace, options.PVC.Name, owner)
+			pv.Annotations[ownerAnnotation] = owner
+		}
+	}
+
+	if p.ContentHash && (adopted || readOnly) {
+		hash, err := p.contentHash(finalPath)
+		if err != nil {
+			klog.Errorf("\tFailed to compute the content hash for [%s]: %s", finalPath, err)
+			return nil, controller.ProvisioningFinished, err
+		}
+		klog.Infof("\tThe content hash for the existing data at [%s] is %s", finalPath, hash)
+		pv.Annotations[contentHashAnnotation] = hash
+		timer.mark("hash")
+	}
+
+	if p.MarkerFile != "" && !readOnly {
+		if err := p.writeMarker(finalPath, pv); err != nil {
+			klog.Errorf("\tFailed to write the marker file for [%s]: %s", finalPath, err)
+			return nil, controller.ProvisioningFinished, err
+		}
+		timer.mark("marker")
+	}
+
 	return pv, controller.ProvisioningFinished, nil
 }
 
+// volumePath computes the path at which the given PV's directory is accessible
+// to this pod
+func (p *HostPathProvisioner) volumePath(volume *v1.PersistentVolume) (string, error) {
+	if volume.Spec.PersistentVolumeSource.HostPath == nil {
+		return "", fmt.Errorf("volume %s is not a hostPath volume", volume.Name)
+	}
+	relPath, err := filepath.Rel(p.PVDir, volume.Spec.PersistentVolumeSource.HostPath.Path)
+	if err != nil {
+		return "", err
+	}
+	return path.Join(p.HostPathMount, relPath), nil
+}
+
 // Delete removes the storage asset that was created by Provision represented
 // by the given PV. The path is read directly from the PV object, to more transparently
 // support the use of the hostPathAnnotation
 func (p *HostPathProvisioner) Delete(ctx context.Context, volume *v1.PersistentVolume) error {
+	var claim, hostPath string
+	if volume.Spec.ClaimRef != nil {
+		claim = volume.Spec.ClaimRef.Namespace + "/" + volume.Spec.ClaimRef.Name
+	}
+	timer := newPhaseTimer()
+	defer p.operations.start("delete", volume.Name, claim, timer)()
+	err := p.delete(ctx, volume, timer)
+	if volume.Spec.HostPath != nil {
+		hostPath = volume.Spec.HostPath.Path
+	}
+	var ignored *controller.IgnoredError
+	switch {
+	case err == nil:
+		p.status.deleted(volume)
+		p.events.publish(lifecycleEvent{Type: eventDeleted, Operation: "delete", Volume: volume.Name, Claim: claim, Path: hostPath})
+	case !errors.As(err, &ignored):
+		p.status.failed(err)
+		p.events.publish(lifecycleEvent{Type: eventFailed, Operation: "delete", Volume: volume.Name, Claim: claim, Path: hostPath, Error: err.Error()})
+	}
+	return err
+}
+
+func (p *HostPathProvisioner) delete(ctx context.Context, volume *v1.PersistentVolume, timer *phaseTimer) error {
 	ann, ok := volume.Annotations[provisionerIdentityAnnotation]
 	if !ok {
 		return errors.New("identity annotation not found on PV")
@@ -333,13 +937,33 @@ func (p *HostPathProvisioner) Delete(ctx context.Context, volume *v1.PersistentV
 
 	hostPath := volume.Spec.PersistentVolumeSource.HostPath.Path
 	klog.Infof("Removing the contents for volume %s at host path [%s]", volume.Name, hostPath)
-	relPath, err := filepath.Rel(p.PVDir, hostPath)
+	fullPath, err := p.volumePath(volume)
 	if err != nil {
 		klog.Fatalf("\tFailed to relativize the host path: %s", err)
 		return err
 	}
 
-	fullPath := path.Join(p.HostPathMount, relPath)
+	// Release whatever the backend set up (i.e. mounts) before the directory
+	// is renamed and removed. Everything needed for this comes from the PV
+	// itself, so volumes are cleaned up correctly even if their StorageClass
+	// is long gone.
+	backendName, backend, err := volumeBackendFor(volume)
+	if err != nil {
+		klog.Errorf("\t%s", err)
+		return err
+	}
+	if _, err := os.Stat(fullPath); err == nil {
+		if err := backend.Release(ctx, fullPath, volume.Annotations); err != nil {
+			klog.Errorf("\tFailed to release the [%s] backend for [%s]: %s", backendName, fullPath, err)
+			return err
+		}
+		if err := p.releaseMount(fullPath); err != nil {
+			klog.Errorf("\t%s", err)
+			return err
+		}
+	}
+	timer.mark("release")
+
 	fullDeletePath := fullPath
 
 	volumeId := string(volume.UID)
@@ -399,21 +1023,33 @@ func (p *HostPathProvisioner) Delete(ctx context.Context, volume *v1.PersistentV
 		}
 	}
 
+	timer.mark("rename")
+
 	klog.Infof("\tDeleting [%s] recursively...", fullDeletePath)
-	if err := os.RemoveAll(fullDeletePath); err != nil {
+	if err := p.removeAll(ctx, fullDeletePath); err != nil {
+		if errors.Is(err, errDeleteInterrupted) {
+			klog.Errorf("\tFailed to remove the contents: %s", err)
+			return err
+		}
 		klog.Fatalf("\tFailed to remove the contents: %s", err)
 		return err
 	}
+	timer.mark("remove")
 	klog.Infof("\tDeletion of [%s] complete!", fullDeletePath)
 	return nil
 }
 
 func main() {
-	syscall.Umask(0)
-
 	flag.Parse()
 	flag.Set("logtostderr", "true")
 
+	if flag.NArg() > 0 && flag.Arg(0) != "verify" {
+		klog.Fatalf("Unknown subcommand [%s]", flag.Arg(0))
+	}
+	if flag.NArg() > 0 && flag.NArg() != 2 {
+		klog.Fatalf("Usage: %s verify <pv-name>", os.Args[0])
+	}
+
 	// Create an InClusterConfig and use it to create a client for the controller
 	// to use to communicate with Kubernetes
 	config, err := rest.InClusterConfig()
@@ -427,12 +1063,73 @@ func main() {
 
 	// Create the provisioner: it implements the Provisioner interface expected by
 	// the controller
-	hostPathProvisioner := NewHostPathProvisioner()
+	hostPathProvisioner := NewHostPathProvisioner(clientset)
+	syscall.Umask(hostPathProvisioner.Umask)
+	hostPathProvisioner.checkUmask()
+
+	// Verify an adopted volume's contents against its content hash, then exit
+	if flag.NArg() > 0 {
+		if err := hostPathProvisioner.verifyVolume(context.Background(), flag.Arg(1)); err != nil {
+			klog.Fatalf("Verification failed: %s", err)
+		}
+		return
+	}
+
+	ctx := context.Background()
+
+	// The controller only serves its metrics once this replica is the leader,
+	// and the startup below may take a while, so these are served on a port of
+	// their own, right away
+	if hostPathProvisioner.HTTPPort > 0 {
+		if _, err := hostPathProvisioner.startHTTPServer(fmt.Sprintf(":%d", hostPathProvisioner.HTTPPort)); err != nil {
+			klog.Fatalf("Failed to serve on HOSTPATH_HTTP_PORT: %s", err)
+		}
+	}
+
+	// Make sure we'll actually be asked to provision something. This can only
+	// hold up the startup if it's meant to stop it.
+	var startupTasks []startupTask
+	switch hostPathProvisioner.StorageClassCheck {
+	case storageClassCheckFatal:
+		if err := hostPathProvisioner.checkStorageClasses(ctx, GetProvisionerName()); err != nil {
+			klog.Fatalf("%s", err)
+		}
+	case storageClassCheckWarn:
+		startupTasks = append(startupTasks, startupTask{"StorageClass check", func(ctx context.Context) {
+			if err := hostPathProvisioner.checkStorageClasses(ctx, GetProvisionerName()); err != nil {
+				klog.Errorf("%s", err)
+			}
+		}})
+	}
+
+	// The controller uses the shared PV cache as well, but won't run it itself
+	options := []func(*controller.ProvisionController) error{
+		controller.MetricsPort(int32(getEnvInt("HOSTPATH_METRICS_PORT", 0))),
+	}
+	if hostPathProvisioner.volumeInformer != nil {
+		options = append(options, controller.VolumesInformer(hostPathProvisioner.volumeInformer))
+		go hostPathProvisioner.volumeInformer.Run(ctx.Done())
+	}
+
+	// Publish the provisioner's state for node-local tools, if so configured.
+	// The totals are seeded before the controller starts, as provisioning and
+	// deleting volumes only adjusts them.
+	if hostPathProvisioner.StatusFile != "" {
+		hostPathProvisioner.seedStatusFile(ctx)
+		go hostPathProvisioner.runStatusFile(ctx)
+	}
+
+	// Keep the marker files and the PV annotations in sync, if so configured
+	if hostPathProvisioner.ReconcileInterval > 0 {
+		startupTasks = append(startupTasks, startupTask{"marker reconciler", hostPathProvisioner.runReconciler})
+	}
+
+	hostPathProvisioner.runStartupTasks(ctx, startupTasks)
 
 	// Start the provision controller which will dynamically provision hostPath
 	// PVs"
-	pc := controller.NewProvisionController(context.Background(), clientset, GetProvisionerName(), hostPathProvisioner)
+	pc := controller.NewProvisionController(ctx, clientset, GetProvisionerName(), hostPathProvisioner, options...)
 
 	// Never stops.
-	pc.Run(context.Background())
+	pc.Run(ctx)
 }
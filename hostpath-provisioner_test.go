@@ -0,0 +1,376 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path"
+	"slices"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+
+	"sigs.k8s.io/sig-storage-lib-external-provisioner/v13/controller"
+
+	v1 "k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/util/retry"
+)
+
+const testIdentity = "test-node"
+
+// newTestProvisioner creates a provisioner with the default settings, whose
+// volumes live in a temporary directory, backed by a fake clientset holding the
+// given objects
+func newTestProvisioner(t *testing.T, objects ...runtime.Object) *HostPathProvisioner {
+	t.Helper()
+	dir := t.TempDir()
+	return &HostPathProvisioner{
+		PVDir:                  dir,
+		Identity:               testIdentity,
+		LocationAnnotation:     locationAnnotation,
+		PvcIdPatternAnnotation: pvcIdPatternAnnotation,
+		PvcIdReplaceAnnotation: pvcIdReplaceAnnotation,
+		PvcUidAnnotation:       pvcUidAnnotation,
+		PvcGidAnnotation:       pvcGidAnnotation,
+		PvcPermAnnotation:      pvcPermAnnotation,
+		PvcBackendAnnotation:   pvcBackendAnnotation,
+		HostPathMount:          dir,
+		Backends:               []string{directoryBackendName},
+		DefaultBackend:         directoryBackendName,
+		ReconcileRepair:        reconcileRepairNone,
+		ModeMismatch:           modeMismatchWarn,
+		StorageClassCheck:      storageClassCheckOff,
+		UpdateRetries:          retry.DefaultRetry.Steps,
+		DeleteMount:            deleteMountUnmount,
+		Client:                 fake.NewClientset(objects...),
+	}
+}
+
+// testClaim builds a 1Gi ReadWriteOnce PVC with the given annotations
+func testClaim(name string, annotations map[string]string) *v1.PersistentVolumeClaim {
+	return &v1.PersistentVolumeClaim{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        name,
+			Namespace:   "default",
+			UID:         types.UID("uid-" + name),
+			Annotations: annotations,
+		},
+		Spec: v1.PersistentVolumeClaimSpec{
+			AccessModes: []v1.PersistentVolumeAccessMode{v1.ReadWriteOnce},
+			Resources: v1.VolumeResourceRequirements{
+				Requests: v1.ResourceList{
+					v1.ResourceStorage: resource.MustParse("1Gi"),
+				},
+			},
+		},
+	}
+}
+
+// testClass builds a StorageClass with the given name and parameters
+func testClass(name string, parameters map[string]string) *storagev1.StorageClass {
+	reclaimPolicy := v1.PersistentVolumeReclaimDelete
+	return &storagev1.StorageClass{
+		ObjectMeta:    metav1.ObjectMeta{Name: name},
+		Provisioner:   "hostpath",
+		Parameters:    parameters,
+		ReclaimPolicy: &reclaimPolicy,
+	}
+}
+
+// testOptions builds the options for provisioning the named volume for the
+// given claim and class
+func testOptions(volumeName string, claim *v1.PersistentVolumeClaim, class *storagev1.StorageClass) controller.ProvisionOptions {
+	return controller.ProvisionOptions{
+		PVName:       volumeName,
+		PVC:          claim,
+		StorageClass: class,
+	}
+}
+
+// testVolume builds a PV owned by the given provisioner at the given path within
+// its volumes' directory, and creates that directory
+func testVolume(t *testing.T, p *HostPathProvisioner, name string, relativePath string) *v1.PersistentVolume {
+	t.Helper()
+	if err := os.MkdirAll(path.Join(p.HostPathMount, relativePath), 0755); err != nil {
+		t.Fatalf("Failed to create the volume directory: %s", err)
+	}
+	return &v1.PersistentVolume{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: name,
+			UID:  types.UID("uid-" + name),
+			Annotations: map[string]string{
+				provisionerIdentityAnnotation: p.Identity,
+				backendAnnotation:             directoryBackendName,
+			},
+		},
+		Spec: v1.PersistentVolumeSpec{
+			PersistentVolumeSource: v1.PersistentVolumeSource{
+				HostPath: &v1.HostPathVolumeSource{
+					Path: path.Join(p.PVDir, relativePath),
+				},
+			},
+		},
+	}
+}
+
+// counterValue reads the current value of the given counter
+func counterValue(t *testing.T, counter prometheus.Counter) float64 {
+	t.Helper()
+	metric := &dto.Metric{}
+	if err := counter.Write(metric); err != nil {
+		t.Fatalf("Failed to read the counter: %s", err)
+	}
+	return metric.GetCounter().GetValue()
+}
+
+func TestStorageClassSubdirsRoundTrip(t *testing.T) {
+	p := newTestProvisioner(t)
+	p.StorageClassSubdirs = true
+
+	tests := []struct {
+		class    string
+		volume   string
+		location string
+		expected string
+	}{
+		{class: "gold", volume: "pv-gold", expected: "gold/pv-gold"},
+		{class: "silver", volume: "pv-silver", expected: "silver/pv-silver"},
+		{class: "silver", volume: "pv-silver-custom", location: "team/data", expected: "silver/team/data"},
+		{class: "bronze/../../x", volume: "pv-odd", expected: "bronze_.._.._x/pv-odd"},
+	}
+
+	var volumes []*v1.PersistentVolume
+	for _, test := range tests {
+		var annotations map[string]string
+		if test.location != "" {
+			annotations = map[string]string{locationAnnotation: test.location}
+		}
+		options := testOptions(test.volume, testClaim("claim-"+test.volume, annotations), testClass(test.class, nil))
+		volume, _, err := p.Provision(context.Background(), options)
+		if err != nil {
+			t.Fatalf("Failed to provision %s: %s", test.volume, err)
+		}
+		expected := path.Join(p.PVDir, test.expected)
+		if volume.Spec.HostPath.Path != expected {
+			t.Errorf("Expected %s at [%s], got [%s]", test.volume, expected, volume.Spec.HostPath.Path)
+		}
+		if info, err := os.Stat(expected); err != nil || !info.IsDir() {
+			t.Errorf("Expected the directory [%s] to exist: %v", expected, err)
+		}
+		volumes = append(volumes, volume)
+	}
+
+	// The absolute paths are stored, so the volumes are deleted regardless of
+	// their classes
+	for i, volume := range volumes {
+		if err := p.Delete(context.Background(), volume); err != nil {
+			t.Fatalf("Failed to delete %s: %s", volume.Name, err)
+		}
+		if _, err := os.Stat(volume.Spec.HostPath.Path); !os.IsNotExist(err) {
+			t.Errorf("Expected [%s] to be removed, got %v", volume.Spec.HostPath.Path, err)
+		}
+		// The other classes' volumes are untouched
+		for _, other := range volumes[i+1:] {
+			if _, err := os.Stat(other.Spec.HostPath.Path); err != nil {
+				t.Errorf("Deleting %s affected [%s]: %s", volume.Name, other.Spec.HostPath.Path, err)
+			}
+		}
+	}
+}
+
+func TestLocationTraversalRejected(t *testing.T) {
+	for _, classSubdirs := range []bool{false, true} {
+		for _, location := range []string{"..", "../silver/stolen", "a/../../silver/stolen", "/..", "/", "."} {
+			p := newTestProvisioner(t)
+			p.StorageClassSubdirs = classSubdirs
+			options := testOptions("pv-traversal", testClaim("claim-traversal", map[string]string{locationAnnotation: location}), testClass("gold", nil))
+			_, _, err := p.Provision(context.Background(), options)
+			var rejected *rejection
+			if !errors.As(err, &rejected) || rejected.reason != rejectPathTraversal {
+				t.Errorf("Expected the location [%s] to be rejected as a path traversal (class subdirectories = %t), got %v", location, classSubdirs, err)
+			}
+			if _, err := os.Stat(path.Join(p.PVDir, "silver")); !os.IsNotExist(err) {
+				t.Errorf("The location [%s] created a directory outside its class", location)
+			}
+		}
+	}
+}
+
+func TestApplyModeMismatch(t *testing.T) {
+	tests := []struct {
+		mismatch string
+		honored  bool
+		fails    bool
+	}{
+		{mismatch: modeMismatchWarn, honored: true},
+		{mismatch: modeMismatchFail, honored: true},
+		{mismatch: modeMismatchWarn, honored: false},
+		{mismatch: modeMismatchFail, honored: false, fails: true},
+	}
+	defer func() { chmod = os.Chmod }()
+	for _, test := range tests {
+		p := newTestProvisioner(t)
+		p.ModeMismatch = test.mismatch
+		dir := path.Join(p.PVDir, "volume")
+		if err := os.Mkdir(dir, 0700); err != nil {
+			t.Fatalf("Failed to create [%s]: %s", dir, err)
+		}
+
+		chmod = os.Chmod
+		if !test.honored {
+			// Like some network filesystems, silently ignore the requested mode
+			chmod = func(name string, mode os.FileMode) error { return nil }
+		}
+		err := p.applyMode(dir, 0775)
+		if test.fails && err == nil {
+			t.Errorf("Expected an unhonored mode to fail in %s mode", test.mismatch)
+		}
+		if !test.fails && err != nil {
+			t.Errorf("Expected no error in %s mode (honored = %t), got %s", test.mismatch, test.honored, err)
+		}
+	}
+}
+
+func TestAllowedSubtrees(t *testing.T) {
+	tests := []struct {
+		location     string
+		classSubdirs bool
+		allowed      bool
+	}{
+		{location: "user-requested/data", allowed: true},
+		{location: "user-requested", allowed: true},
+		{location: "/shared/data/team/", allowed: true},
+		{location: "user-requested-not/data"},
+		{location: "shared/other"},
+		{location: "elsewhere"},
+		{location: "user-requested/../elsewhere"},
+		// The class' subdirectory is part of the path the subtrees are matched against
+		{location: "user-requested/data", classSubdirs: true},
+		{location: "gold-only/data", classSubdirs: true, allowed: true},
+	}
+	for _, test := range tests {
+		p := newTestProvisioner(t)
+		p.AllowedSubtrees = parseSubtrees("user-requested, shared/data,gold/gold-only,")
+		p.StorageClassSubdirs = test.classSubdirs
+		claim := testClaim("claim-subtree", map[string]string{locationAnnotation: test.location})
+		_, _, err := p.Provision(context.Background(), testOptions("pv-subtree", claim, testClass("gold", nil)))
+		if test.allowed && err != nil {
+			t.Errorf("Expected the location [%s] to be allowed (class subdirectories = %t), got %s", test.location, test.classSubdirs, err)
+		}
+		if !test.allowed {
+			var rejected *rejection
+			if !errors.As(err, &rejected) || rejected.reason != rejectPathNotAllowed {
+				t.Errorf("Expected the location [%s] to be rejected (class subdirectories = %t), got %v", test.location, test.classSubdirs, err)
+			}
+		}
+	}
+
+	// Volumes without the annotation aren't restricted
+	p := newTestProvisioner(t)
+	p.AllowedSubtrees = []string{"user-requested"}
+	if _, _, err := p.Provision(context.Background(), testOptions("pv-default", testClaim("claim-default", nil), testClass("gold", nil))); err != nil {
+		t.Errorf("Expected the default path to be allowed, got %s", err)
+	}
+}
+
+func TestParseSubtrees(t *testing.T) {
+	got := parseSubtrees(" a/b/ ,/c,, d/../e ,/")
+	expected := []string{"a/b", "c", "e"}
+	if !slices.Equal(got, expected) {
+		t.Errorf("Expected %v, got %v", expected, got)
+	}
+}
+
+func TestClaimOwner(t *testing.T) {
+	controls := true
+	for _, test := range []struct {
+		name     string
+		owners   []metav1.OwnerReference
+		expected string
+	}{
+		{name: "no owners", expected: ""},
+		{
+			name:     "a single owner",
+			owners:   []metav1.OwnerReference{{Kind: "StatefulSet", Name: "db"}},
+			expected: "StatefulSet/db",
+		},
+		{
+			name: "the controller wins",
+			owners: []metav1.OwnerReference{
+				{Kind: "ConfigMap", Name: "config"},
+				{Kind: "StatefulSet", Name: "db", Controller: &controls},
+			},
+			expected: "StatefulSet/db",
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			claim := testClaim("claim", nil)
+			claim.OwnerReferences = test.owners
+			if got := claimOwner(claim); got != test.expected {
+				t.Errorf("Expected the owner [%s], got [%s]", test.expected, got)
+			}
+		})
+	}
+}
+
+func TestRecordOwner(t *testing.T) {
+	for _, test := range []struct {
+		name     string
+		record   bool
+		owners   []metav1.OwnerReference
+		expected string
+	}{
+		{
+			name:     "with owner references",
+			record:   true,
+			owners:   []metav1.OwnerReference{{Kind: "StatefulSet", Name: "db"}},
+			expected: "StatefulSet/db",
+		},
+		{name: "without owner references", record: true},
+		{
+			name:   "disabled",
+			owners: []metav1.OwnerReference{{Kind: "StatefulSet", Name: "db"}},
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			p := newTestProvisioner(t)
+			p.RecordOwner = test.record
+			claim := testClaim("claim", nil)
+			claim.OwnerReferences = test.owners
+
+			volume, _, err := p.Provision(context.Background(), testOptions("pv", claim, testClass("standard", nil)))
+			if err != nil {
+				t.Fatalf("Provisioning failed: %s", err)
+			}
+			owner, ok := volume.Annotations[ownerAnnotation]
+			if test.expected == "" && ok {
+				t.Errorf("Expected no owner annotation, got [%s]", owner)
+			} else if owner != test.expected {
+				t.Errorf("Expected the owner annotation [%s], got [%s]", test.expected, owner)
+			}
+		})
+	}
+}
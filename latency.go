@@ -0,0 +1,128 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"sigs.k8s.io/sig-storage-lib-external-provisioner/v13/controller"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	klog "k8s.io/klog/v2"
+)
+
+// A single timed phase of an operation
+type phaseDuration struct {
+	name     string
+	duration time.Duration
+}
+
+// phaseTimer breaks an operation's duration down by phase. Each call to mark()
+// attributes the time since the previous one to the named phase.
+type phaseTimer struct {
+	start  time.Time
+	last   time.Time
+	phases []phaseDuration
+
+	// Called with each phase's name as it completes (may be nil)
+	onMark func(name string)
+}
+
+func newPhaseTimer() *phaseTimer {
+	now := time.Now()
+	return &phaseTimer{start: now, last: now}
+}
+
+func (t *phaseTimer) mark(name string) {
+	now := time.Now()
+	t.phases = append(t.phases, phaseDuration{name: name, duration: now.Sub(t.last)})
+	t.last = now
+	if t.onMark != nil {
+		t.onMark(name)
+	}
+}
+
+// elapsed returns the operation's total duration so far, which includes any
+// time not yet attributed to a phase
+func (t *phaseTimer) elapsed() time.Duration {
+	return time.Since(t.start)
+}
+
+func (t *phaseTimer) String() string {
+	parts := make([]string, 0, len(t.phases))
+	for _, phase := range t.phases {
+		parts = append(parts, fmt.Sprintf("%s=%s", phase.name, phase.duration))
+	}
+	return strings.Join(parts, " ")
+}
+
+// postEvent posts a warning event on the given PVC. Unlike with an event
+// recorder, the outcome is known, so the caller can apply the degradation
+// policy to it.
+func (p *HostPathProvisioner) postEvent(ctx context.Context, claim *v1.PersistentVolumeClaim, reason string, message string) error {
+	now := metav1.Now()
+	event := &v1.Event{
+		ObjectMeta: metav1.ObjectMeta{
+			GenerateName: claim.Name + ".",
+			Namespace:    claim.Namespace,
+		},
+		InvolvedObject: v1.ObjectReference{
+			Kind:            "PersistentVolumeClaim",
+			APIVersion:      "v1",
+			Namespace:       claim.Namespace,
+			Name:            claim.Name,
+			UID:             claim.UID,
+			ResourceVersion: claim.ResourceVersion,
+		},
+		Reason:         reason,
+		Message:        message,
+		Type:           v1.EventTypeWarning,
+		Source:         v1.EventSource{Component: GetProvisionerName()},
+		FirstTimestamp: now,
+		LastTimestamp:  now,
+		Count:          1,
+	}
+	_, err := p.Client.CoreV1().Events(claim.Namespace).Create(ctx, event, metav1.CreateOptions{})
+	return err
+}
+
+// checkProvisionLatency reports provisioning operations which took longer than
+// the configured threshold, with the breakdown of where the time was spent.
+// Only a failure to post the event, in strict mode, is returned.
+func (p *HostPathProvisioner) checkProvisionLatency(ctx context.Context, options controller.ProvisionOptions, timer *phaseTimer) error {
+	if p.SlowProvisionThreshold <= 0 {
+		return nil
+	}
+	elapsed := timer.elapsed()
+	if elapsed <= p.SlowProvisionThreshold {
+		return nil
+	}
+
+	slowProvisionTotal.Inc()
+	klog.Warningf("Provisioning volume %s for PVC %s/%s took %s, over the %s threshold (%s)", options.PVName, options.PVC.Namespace, options.PVC.Name, elapsed, p.SlowProvisionThreshold, timer)
+	if p.SlowProvisionEvent && p.Client != nil {
+		message := fmt.Sprintf("Provisioning volume %s took %s, over the %s threshold (%s)", options.PVName, elapsed, p.SlowProvisionThreshold, timer)
+		if err := p.postEvent(ctx, options.PVC, "SlowProvisioning", message); err != nil {
+			return p.auxiliaryFailed(auxiliaryPostEvent, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,134 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"os"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	klog "k8s.io/klog/v2"
+)
+
+// captureLogs redirects the log output into the returned buffer for the rest of
+// the test. Every message reaches the info log, whatever its severity, so only
+// that one is kept to avoid duplicates.
+func captureLogs(t *testing.T) *bytes.Buffer {
+	var buffer bytes.Buffer
+	klog.LogToStderr(false)
+	klog.SetOutput(io.Discard)
+	klog.SetOutputBySeverity("INFO", &buffer)
+	t.Cleanup(func() {
+		klog.SetOutput(os.Stderr)
+		klog.LogToStderr(true)
+	})
+	return &buffer
+}
+
+// listEvents lists the events posted in the test PVCs' namespace
+func listEvents(t *testing.T, p *HostPathProvisioner) []v1.Event {
+	t.Helper()
+	events, err := p.Client.CoreV1().Events("default").List(context.Background(), metav1.ListOptions{})
+	if err != nil {
+		t.Fatalf("Failed to list the events: %s", err)
+	}
+	return events.Items
+}
+
+// stubSlowChmod makes every chmod take at least the given delay
+func stubSlowChmod(t *testing.T, delay time.Duration) {
+	t.Cleanup(func() { chmod = os.Chmod })
+	chmod = func(name string, mode os.FileMode) error {
+		time.Sleep(delay)
+		return os.Chmod(name, mode)
+	}
+}
+
+// The breakdown entry for the chmod phase, and its duration
+var chmodPhase = regexp.MustCompile(`chmod=([0-9.]+[a-zµ]+)`)
+
+func TestSlowProvision(t *testing.T) {
+	p := newTestProvisioner(t)
+	p.SlowProvisionThreshold = 50 * time.Millisecond
+	p.SlowProvisionEvent = true
+	stubSlowChmod(t, 100*time.Millisecond)
+	logs := captureLogs(t)
+
+	before := counterValue(t, slowProvisionTotal)
+	if _, _, err := p.Provision(context.Background(), testOptions("pv-slow", testClaim("claim", nil), testClass("standard", nil))); err != nil {
+		t.Fatalf("Provisioning failed: %s", err)
+	}
+	klog.Flush()
+
+	if got := counterValue(t, slowProvisionTotal); got != before+1 {
+		t.Errorf("Expected the slow provisioning to be counted once, the counter went %v -> %v", before, got)
+	}
+
+	var warning string
+	for _, line := range strings.Split(logs.String(), "\n") {
+		if strings.Contains(line, "over the 50ms threshold") {
+			warning = line
+		}
+	}
+	if warning == "" {
+		t.Fatalf("The slow provisioning wasn't logged:\n%s", logs)
+	}
+	for _, phase := range []string{"validate=", "mkdir=", "backend=", "chmod=", "chown="} {
+		if !strings.Contains(warning, phase) {
+			t.Errorf("The breakdown lacks the %s phase: %s", strings.TrimSuffix(phase, "="), warning)
+		}
+	}
+	match := chmodPhase.FindStringSubmatch(warning)
+	if match == nil {
+		t.Fatalf("The breakdown lacks the chmod phase's duration: %s", warning)
+	}
+	if duration, err := time.ParseDuration(match[1]); err != nil || duration < 100*time.Millisecond {
+		t.Errorf("Expected the slow chmod to be blamed, got chmod=%s", match[1])
+	}
+
+	events := listEvents(t, p)
+	if len(events) != 1 {
+		t.Fatalf("Expected an event for the slow provisioning, got %+v", events)
+	}
+	if event := events[0]; event.Reason != "SlowProvisioning" || event.Type != v1.EventTypeWarning || event.InvolvedObject.Name != "claim" || !strings.Contains(event.Message, "chmod=") {
+		t.Errorf("Unexpected event: %+v", event)
+	}
+}
+
+func TestFastProvision(t *testing.T) {
+	p := newTestProvisioner(t)
+	p.SlowProvisionThreshold = time.Hour
+	p.SlowProvisionEvent = true
+
+	before := counterValue(t, slowProvisionTotal)
+	if _, _, err := p.Provision(context.Background(), testOptions("pv-fast", testClaim("claim", nil), testClass("standard", nil))); err != nil {
+		t.Fatalf("Provisioning failed: %s", err)
+	}
+	if got := counterValue(t, slowProvisionTotal); got != before {
+		t.Errorf("A fast provisioning was counted as slow: %v -> %v", before, got)
+	}
+	if events := listEvents(t, p); len(events) > 0 {
+		t.Errorf("Unexpected events for a fast provisioning: %+v", events)
+	}
+}
@@ -0,0 +1,108 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"os"
+	"path"
+	"sort"
+	"strings"
+
+	yaml "gopkg.in/yaml.v3"
+
+	v1 "k8s.io/api/core/v1"
+)
+
+// Only the annotations with this prefix are recorded in the marker files, since
+// those are the ones this provisioner owns
+const markerAnnotationPrefix = "hostpath/"
+
+// The contents of the marker file written into each volume's directory
+type volumeMarker struct {
+	Volume      string            `yaml:"volume"`
+	Annotations map[string]string `yaml:"annotations"`
+}
+
+// Extract the annotations this provisioner owns from the given PV
+func markerAnnotations(volume *v1.PersistentVolume) map[string]string {
+	result := map[string]string{}
+	for key, value := range volume.Annotations {
+		if strings.HasPrefix(key, markerAnnotationPrefix) {
+			result[key] = value
+		}
+	}
+	return result
+}
+
+// Write out the marker file for the given PV into the given volume directory
+func (p *HostPathProvisioner) writeMarker(volumePath string, volume *v1.PersistentVolume) error {
+	data, err := yaml.Marshal(volumeMarker{
+		Volume:      volume.Name,
+		Annotations: markerAnnotations(volume),
+	})
+	if err != nil {
+		return err
+	}
+
+	// Write to a temporary file first and rename it into place, so a reader
+	// never sees a partially-written marker
+	markerPath := path.Join(volumePath, p.MarkerFile)
+	tempPath := markerPath + ".tmp"
+	if err := os.WriteFile(tempPath, data, 0644); err != nil {
+		return err
+	}
+	if err := os.Rename(tempPath, markerPath); err != nil {
+		os.Remove(tempPath)
+		return err
+	}
+	return nil
+}
+
+// Read the marker file from the given volume directory. If the marker doesn't
+// exist, the error will satisfy os.IsNotExist()
+func (p *HostPathProvisioner) readMarker(volumePath string) (*volumeMarker, error) {
+	data, err := os.ReadFile(path.Join(volumePath, p.MarkerFile))
+	if err != nil {
+		return nil, err
+	}
+	marker := &volumeMarker{}
+	if err := yaml.Unmarshal(data, marker); err != nil {
+		return nil, err
+	}
+	if marker.Annotations == nil {
+		marker.Annotations = map[string]string{}
+	}
+	return marker, nil
+}
+
+// Compute the (sorted) list of annotation keys whose values differ between
+// the two given maps
+func diffAnnotations(a, b map[string]string) []string {
+	var result []string
+	for key, value := range a {
+		if other, ok := b[key]; !ok || other != value {
+			result = append(result, key)
+		}
+	}
+	for key := range b {
+		if _, ok := a[key]; !ok {
+			result = append(result, key)
+		}
+	}
+	sort.Strings(result)
+	return result
+}
@@ -0,0 +1,90 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// These metrics are registered with the default registry, so they're served
+// alongside the controller's own metrics when HOSTPATH_METRICS_PORT is set
+var (
+	markerDiscrepanciesTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "hostpath_provisioner_marker_discrepancies_total",
+			Help: "Total number of discrepancies found between PV annotations and volume marker files. Broken down by whether they were repaired.",
+		},
+		[]string{"repaired"},
+	)
+
+	capacityRejectionsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "hostpath_provisioner_capacity_rejections_total",
+			Help: "Total number of provisioning attempts rejected because the filesystem was full. Broken down by the exhausted resource (bytes or inodes).",
+		},
+		[]string{"resource"},
+	)
+
+	rejectionsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "hostpath_provisioner_rejections_total",
+			Help: "Total number of provisioning requests rejected by validation. Broken down by the reason for the rejection.",
+		},
+		[]string{"reason"},
+	)
+
+	slowProvisionTotal = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "hostpath_provisioner_slow_provision_total",
+			Help: "Total number of provisioning operations which took longer than HOSTPATH_SLOW_PROVISION_THRESHOLD.",
+		},
+	)
+
+	auxiliaryFailuresTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "hostpath_provisioner_auxiliary_failures_total",
+			Help: "Total number of failed auxiliary API calls, which the provisioner carries on without unless HOSTPATH_STRICT_AUXILIARY is set. Broken down by operation.",
+		},
+		[]string{"operation"},
+	)
+
+	eventsDroppedTotal = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "hostpath_provisioner_events_dropped_total",
+			Help: "Total number of lifecycle events dropped because an /events client wasn't keeping up.",
+		},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(
+		markerDiscrepanciesTotal,
+		capacityRejectionsTotal,
+		rejectionsTotal,
+		slowProvisionTotal,
+		auxiliaryFailuresTotal,
+		eventsDroppedTotal,
+	)
+
+	// Make every reason show up, even before it's ever been used
+	for _, reason := range rejectionReasons {
+		rejectionsTotal.WithLabelValues(reason)
+	}
+	for _, operation := range auxiliaryOperations {
+		auxiliaryFailuresTotal.WithLabelValues(operation)
+	}
+}
@@ -0,0 +1,173 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"syscall"
+
+	klog "k8s.io/klog/v2"
+)
+
+const deleteMountUnmount = "unmount"
+const deleteMountRefuse = "refuse"
+const deleteMountIgnore = "ignore"
+
+// The mount table for this process' mount namespace
+var mountInfoPath = "/proc/self/mountinfo"
+
+var mount = syscall.Mount
+var unmount = syscall.Unmount
+var sameDirectory = isSameDirectory
+
+// unescapeMountPath decodes the octal escapes (i.e. "\040" for a space) used
+// for the paths in the mount table
+func unescapeMountPath(value string) string {
+	if !strings.Contains(value, "\\") {
+		return value
+	}
+	var result strings.Builder
+	for i := 0; i < len(value); i++ {
+		if value[i] == '\\' && i+3 < len(value) {
+			if code, err := strconv.ParseUint(value[i+1:i+4], 8, 8); err == nil {
+				result.WriteByte(byte(code))
+				i += 3
+				continue
+			}
+		}
+		result.WriteByte(value[i])
+	}
+	return result.String()
+}
+
+// A mount table entry
+type mountEntry struct {
+	MountPoint string
+	Options    []string
+	FSType     string
+	Source     string
+}
+
+// readOnly returns true if the mount is read-only
+func (m *mountEntry) readOnly() bool {
+	return slices.Contains(m.Options, "ro")
+}
+
+// findMount returns the topmost mount table entry for the given mount point,
+// or nil if nothing is mounted there
+func findMount(path string) (*mountEntry, error) {
+	path = filepath.Clean(path)
+	file, err := os.Open(mountInfoPath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var result *mountEntry
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		// i.e.: 36 35 98:0 /mnt1 /mnt2 rw,noatime master:1 - ext3 /dev/root rw,errors=continue
+		// The 5th field is the mount point, the 6th its options, and the file
+		// system type and source follow the "-" separator (after the optional
+		// fields). Later entries are mounted on top of earlier ones.
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 6 || unescapeMountPath(fields[4]) != path {
+			continue
+		}
+		entry := &mountEntry{
+			MountPoint: path,
+			Options:    strings.Split(fields[5], ","),
+		}
+		if separator := slices.Index(fields, "-"); separator >= 0 && separator+2 < len(fields) {
+			entry.FSType = fields[separator+1]
+			entry.Source = unescapeMountPath(fields[separator+2])
+		}
+		result = entry
+	}
+	return result, scanner.Err()
+}
+
+// isSameDirectory returns true if both paths lead to the same directory (i.e.
+// one of them is a bind mount of the other)
+func isSameDirectory(a string, b string) (bool, error) {
+	infoA, err := os.Stat(a)
+	if err != nil {
+		return false, err
+	}
+	infoB, err := os.Stat(b)
+	if err != nil {
+		return false, err
+	}
+	return os.SameFile(infoA, infoB), nil
+}
+
+// isMountPoint returns true if something is mounted at the given path: either
+// it's on a different device than its parent, or (for bind mounts from the same
+// device) it's listed in the mount table
+func isMountPoint(path string) (bool, error) {
+	path = filepath.Clean(path)
+	var stat, parentStat syscall.Stat_t
+	if err := syscall.Lstat(path, &stat); err != nil {
+		return false, err
+	}
+	if err := syscall.Lstat(filepath.Dir(path), &parentStat); err != nil {
+		return false, err
+	}
+	if stat.Dev != parentStat.Dev {
+		return true, nil
+	}
+
+	entry, err := findMount(path)
+	return entry != nil, err
+}
+
+// releaseMount deals with anything still mounted at the volume's path before
+// it's removed, as removing the contents of a mount is either dangerous (i.e.
+// a bind mount of shared data) or pointless
+func (p *HostPathProvisioner) releaseMount(fullPath string) error {
+	if p.DeleteMount == deleteMountIgnore {
+		return nil
+	}
+	mounted, err := isMountPoint(fullPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return fmt.Errorf("failed to determine whether [%s] is a mount point: %w", fullPath, err)
+	}
+	if !mounted {
+		return nil
+	}
+	if p.DeleteMount == deleteMountRefuse {
+		return fmt.Errorf("[%s] is still a mount point, refusing to delete it", fullPath)
+	}
+
+	klog.Infof("\tUnmounting [%s] before removing it", fullPath)
+	if err := unmount(fullPath, 0); err != nil {
+		if err == syscall.EBUSY {
+			return fmt.Errorf("failed to unmount [%s], it's still in use: %w", fullPath, err)
+		}
+		return fmt.Errorf("failed to unmount [%s]: %w", fullPath, err)
+	}
+	return nil
+}
@@ -0,0 +1,267 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+// fakeMountTable stands in for the mount table, and for the calls which change
+// it, so mounts can be exercised without the privileges to make them
+type fakeMountTable struct {
+	t       *testing.T
+	file    string
+	entries []mountEntry
+
+	// The paths unmounted so far, in order, and whether each one still existed
+	// at the time
+	unmounted []string
+	existed   []bool
+
+	// The mounts made so far, in order
+	mounts []mountCall
+
+	// The errors to fail the mounts (or just the remounts) and unmounts with
+	mountErr   error
+	remountErr error
+	unmountErr error
+}
+
+// The arguments of a mount call
+type mountCall struct {
+	source string
+	target string
+	fstype string
+	flags  uintptr
+	data   string
+}
+
+func stubMountTable(t *testing.T) *fakeMountTable {
+	m := &fakeMountTable{t: t, file: path.Join(t.TempDir(), "mountinfo")}
+	oldPath, oldMount, oldUnmount, oldSame := mountInfoPath, mount, unmount, sameDirectory
+	t.Cleanup(func() {
+		mountInfoPath, mount, unmount, sameDirectory = oldPath, oldMount, oldUnmount, oldSame
+	})
+	mountInfoPath = m.file
+	mount = m.mount
+	unmount = m.unmount
+	sameDirectory = m.sameDirectory
+	m.write()
+	return m
+}
+
+// add mounts the given entry on top of whatever's already at its mount point
+func (m *fakeMountTable) add(entry mountEntry) {
+	m.entries = append(m.entries, entry)
+	m.write()
+}
+
+func (m *fakeMountTable) write() {
+	m.t.Helper()
+	var lines []string
+	for i, entry := range m.entries {
+		options := "rw"
+		if len(entry.Options) > 0 {
+			options = strings.Join(entry.Options, ",")
+		}
+		lines = append(lines, fmt.Sprintf("%d 1 0:%d / %s %s - %s %s rw", 100+i, 100+i, entry.MountPoint, options, entry.FSType, entry.Source))
+	}
+	if err := os.WriteFile(m.file, []byte(strings.Join(lines, "\n")+"\n"), 0644); err != nil {
+		m.t.Fatalf("Failed to write the mount table: %s", err)
+	}
+}
+
+// top returns the topmost entry mounted at the given path (if any)
+func (m *fakeMountTable) top(target string) *mountEntry {
+	for i := len(m.entries) - 1; i >= 0; i-- {
+		if m.entries[i].MountPoint == target {
+			return &m.entries[i]
+		}
+	}
+	return nil
+}
+
+// sameDirectory compares the given paths once the (fake) bind mounts on them
+// are resolved, as the fake mounts leave the directories themselves alone
+func (m *fakeMountTable) sameDirectory(a string, b string) (bool, error) {
+	resolve := func(name string) string {
+		name = filepath.Clean(name)
+		if entry := m.top(name); entry != nil && entry.FSType == "none" {
+			return filepath.Clean(entry.Source)
+		}
+		return name
+	}
+	return resolve(a) == resolve(b), nil
+}
+
+func (m *fakeMountTable) mount(source string, target string, fstype string, flags uintptr, data string) error {
+	if m.mountErr != nil {
+		return m.mountErr
+	}
+	if flags&syscall.MS_REMOUNT != 0 {
+		if m.remountErr != nil {
+			return m.remountErr
+		}
+		entry := m.top(target)
+		if entry == nil {
+			return syscall.EINVAL
+		}
+		entry.Options = []string{"rw"}
+		if flags&syscall.MS_RDONLY != 0 {
+			entry.Options = []string{"ro"}
+		}
+	} else {
+		entry := mountEntry{MountPoint: target, FSType: fstype, Source: source}
+		if flags&syscall.MS_BIND != 0 {
+			entry.FSType = "none"
+		}
+		m.entries = append(m.entries, entry)
+	}
+	m.mounts = append(m.mounts, mountCall{source: source, target: target, fstype: fstype, flags: flags, data: data})
+	m.write()
+	return nil
+}
+
+func (m *fakeMountTable) unmount(target string, flags int) error {
+	if m.unmountErr != nil {
+		return m.unmountErr
+	}
+	for i := len(m.entries) - 1; i >= 0; i-- {
+		if m.entries[i].MountPoint == target {
+			_, err := os.Stat(target)
+			m.unmounted = append(m.unmounted, target)
+			m.existed = append(m.existed, err == nil)
+			m.entries = append(m.entries[:i], m.entries[i+1:]...)
+			m.write()
+			return nil
+		}
+	}
+	return syscall.EINVAL
+}
+
+func TestDeleteMountPoint(t *testing.T) {
+	for _, test := range []struct {
+		name       string
+		mode       string
+		mounted    bool
+		unmountErr error
+		unmounts   bool
+		fails      string
+	}{
+		{name: "unmounted path", mode: deleteMountUnmount},
+		{name: "mounted path", mode: deleteMountUnmount, mounted: true, unmounts: true},
+		{name: "busy mount", mode: deleteMountUnmount, mounted: true, unmountErr: syscall.EBUSY, fails: "still in use"},
+		{name: "failed unmount", mode: deleteMountUnmount, mounted: true, unmountErr: syscall.EPERM, fails: "failed to unmount"},
+		{name: "refused", mode: deleteMountRefuse, mounted: true, fails: "refusing to delete it"},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			p := newTestProvisioner(t)
+			p.DeleteMount = test.mode
+			mounts := stubMountTable(t)
+			mounts.unmountErr = test.unmountErr
+			volume := testVolume(t, p, "pv", "pv")
+			volumePath := path.Join(p.HostPathMount, "pv")
+			if err := os.WriteFile(path.Join(volumePath, "data"), []byte("data"), 0644); err != nil {
+				t.Fatalf("Failed to write the volume's contents: %s", err)
+			}
+			if test.mounted {
+				mounts.add(mountEntry{MountPoint: volumePath, FSType: "ext4", Source: "/dev/loop0"})
+			}
+
+			err := p.Delete(context.Background(), volume)
+			if test.fails != "" {
+				if err == nil || !strings.Contains(err.Error(), test.fails) {
+					t.Fatalf("Expected the deletion to fail with [%s], got %v", test.fails, err)
+				}
+				if _, err := os.Stat(path.Join(volumePath, "data")); err != nil {
+					t.Errorf("The volume's contents were removed despite the failure: %s", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("The deletion failed: %s", err)
+			}
+
+			if test.unmounts {
+				if len(mounts.unmounted) != 1 || mounts.unmounted[0] != volumePath {
+					t.Fatalf("Expected [%s] to be unmounted, got %v", volumePath, mounts.unmounted)
+				}
+				if !mounts.existed[0] {
+					t.Errorf("The volume was removed before it was unmounted")
+				}
+			} else if len(mounts.unmounted) > 0 {
+				t.Errorf("Expected no unmounts, got %v", mounts.unmounted)
+			}
+			entries, err := os.ReadDir(p.HostPathMount)
+			if err != nil {
+				t.Fatalf("Failed to list the volumes directory: %s", err)
+			}
+			if len(entries) > 0 {
+				t.Errorf("The volume wasn't removed: %v", entries)
+			}
+		})
+	}
+}
+
+func TestUnescapeMountPath(t *testing.T) {
+	for value, expected := range map[string]string{
+		"/plain":              "/plain",
+		`/with\040space`:      "/with space",
+		`/tab\011and\134back`: "/tab\tand\\back",
+		`/bad\9escape`:        `/bad\9escape`,
+	} {
+		if got := unescapeMountPath(value); got != expected {
+			t.Errorf("Expected [%s] to unescape to [%s], got [%s]", value, expected, got)
+		}
+	}
+}
+
+func TestIsSameDirectory(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"a", "b"} {
+		if err := os.Mkdir(path.Join(dir, name), 0755); err != nil {
+			t.Fatalf("Failed to create [%s]: %s", name, err)
+		}
+	}
+	if err := os.Symlink(path.Join(dir, "a"), path.Join(dir, "link")); err != nil {
+		t.Fatalf("Failed to create the link: %s", err)
+	}
+
+	for _, test := range []struct {
+		a, b     string
+		expected bool
+	}{
+		{a: "a", b: "a", expected: true},
+		{a: "a", b: "link", expected: true},
+		{a: "a", b: "b", expected: false},
+	} {
+		same, err := isSameDirectory(path.Join(dir, test.a), path.Join(dir, test.b))
+		if err != nil || same != test.expected {
+			t.Errorf("Expected [%s] and [%s] to be the same directory: %t, got %t (%v)", test.a, test.b, test.expected, same, err)
+		}
+	}
+	if _, err := isSameDirectory(path.Join(dir, "a"), path.Join(dir, "missing")); !os.IsNotExist(err) {
+		t.Errorf("Expected a missing directory to fail the comparison, got %v", err)
+	}
+}
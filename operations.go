@@ -0,0 +1,107 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	klog "k8s.io/klog/v2"
+)
+
+// An in-flight Provision or Delete operation
+type operation struct {
+	Operation string    `json:"operation"`
+	Volume    string    `json:"volume"`
+	Claim     string    `json:"claim,omitempty"`
+	Started   time.Time `json:"started"`
+	// The most recently completed phase (empty if none has completed yet)
+	LastPhase string `json:"lastPhase"`
+	Elapsed   string `json:"elapsed"`
+
+	id uint64
+}
+
+// operationTracker keeps track of the in-flight operations, for /debug/operations.
+// All its methods are safe to call on a nil instance, which does nothing.
+type operationTracker struct {
+	lock       sync.Mutex
+	nextId     uint64
+	operations map[uint64]*operation
+}
+
+func newOperationTracker(enabled bool) *operationTracker {
+	if !enabled {
+		return nil
+	}
+	return &operationTracker{operations: map[uint64]*operation{}}
+}
+
+// start begins tracking an operation, returning the function that must be
+// called when it's finished
+func (t *operationTracker) start(kind string, volume string, claim string, timer *phaseTimer) func() {
+	if t == nil {
+		return func() {}
+	}
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.nextId++
+	op := &operation{
+		Operation: kind,
+		Volume:    volume,
+		Claim:     claim,
+		Started:   timer.start,
+		id:        t.nextId,
+	}
+	t.operations[op.id] = op
+	timer.onMark = func(name string) {
+		t.lock.Lock()
+		defer t.lock.Unlock()
+		op.LastPhase = name
+	}
+	return func() {
+		t.lock.Lock()
+		defer t.lock.Unlock()
+		delete(t.operations, op.id)
+	}
+}
+
+// list returns a snapshot of the in-flight operations, oldest first
+func (t *operationTracker) list() []operation {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	now := time.Now()
+	result := make([]operation, 0, len(t.operations))
+	for _, op := range t.operations {
+		snapshot := *op
+		snapshot.Elapsed = now.Sub(op.Started).Round(time.Millisecond).String()
+		result = append(result, snapshot)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].id < result[j].id })
+	return result
+}
+
+// serveOperations handles /debug/operations, listing the in-flight operations
+func (t *operationTracker) serveOperations(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(t.list()); err != nil {
+		klog.Warningf("Failed to write the in-flight operations: %s", err)
+	}
+}
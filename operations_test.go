@@ -0,0 +1,137 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+)
+
+// listOperations fetches the in-flight operations from /debug/operations
+func listOperations(t *testing.T, server *httptest.Server) []operation {
+	t.Helper()
+	response, err := http.Get(server.URL + "/debug/operations")
+	if err != nil {
+		t.Fatalf("Failed to fetch the operations: %s", err)
+	}
+	defer response.Body.Close()
+	var result []operation
+	if err := json.NewDecoder(response.Body).Decode(&result); err != nil {
+		t.Fatalf("Failed to decode the operations: %s", err)
+	}
+	return result
+}
+
+// waitForOperations waits until the number of in-flight operations matches
+func waitForOperations(t *testing.T, server *httptest.Server, count int) []operation {
+	t.Helper()
+	var result []operation
+	err := wait.PollUntilContextTimeout(context.Background(), 10*time.Millisecond, 5*time.Second, true, func(context.Context) (bool, error) {
+		result = listOperations(t, server)
+		return len(result) == count, nil
+	})
+	if err != nil {
+		t.Fatalf("Expected %d in-flight operations, got %+v", count, result)
+	}
+	return result
+}
+
+func TestOperationsListing(t *testing.T) {
+	p := newTestProvisioner(t)
+	p.operations = newOperationTracker(true)
+	backend := &fakeBackend{setup: "setup"}
+	useFakeBackend(t, p, backend)
+	server := httptest.NewServer(http.HandlerFunc(p.operations.serveOperations))
+	defer server.Close()
+
+	if ops := listOperations(t, server); len(ops) != 0 {
+		t.Fatalf("Expected no in-flight operations, got %+v", ops)
+	}
+
+	// The backend holds the provisioning up, after the directory's been made
+	backend.hold = make(chan struct{})
+	provisioned := make(chan *v1.PersistentVolume)
+	go func() {
+		volume, _, err := p.Provision(context.Background(), testOptions("pv", testClaim("claim", nil), testClass("standard", nil)))
+		if err != nil {
+			t.Errorf("Provisioning failed: %s", err)
+		}
+		provisioned <- volume
+	}()
+	ops := waitForOperations(t, server, 1)
+	if op := ops[0]; op.Operation != "provision" || op.Volume != "pv" || op.Claim != "default/claim" || op.LastPhase != "mkdir" || op.Started.IsZero() || op.Elapsed == "" {
+		t.Errorf("Unexpected in-flight provisioning: %+v", op)
+	}
+	close(backend.hold)
+	volume := <-provisioned
+	waitForOperations(t, server, 0)
+	if volume == nil {
+		t.FailNow()
+	}
+
+	// Likewise for the deletion, while the backend's being released
+	backend.hold = make(chan struct{})
+	volume.Spec.ClaimRef = &v1.ObjectReference{Namespace: "default", Name: "claim"}
+	deleted := make(chan struct{})
+	go func() {
+		if err := p.Delete(context.Background(), volume); err != nil {
+			t.Errorf("Deletion failed: %s", err)
+		}
+		close(deleted)
+	}()
+	ops = waitForOperations(t, server, 1)
+	if op := ops[0]; op.Operation != "delete" || op.Volume != "pv" || op.Claim != "default/claim" || op.LastPhase != "" {
+		t.Errorf("Unexpected in-flight deletion: %+v", op)
+	}
+	close(backend.hold)
+	<-deleted
+	waitForOperations(t, server, 0)
+}
+
+func TestOperationsOrder(t *testing.T) {
+	tracker := newOperationTracker(true)
+	first := tracker.start("provision", "pv-1", "default/claim-1", newPhaseTimer())
+	second := tracker.start("delete", "pv-2", "", newPhaseTimer())
+	third := tracker.start("provision", "pv-3", "default/claim-3", newPhaseTimer())
+
+	second()
+	ops := tracker.list()
+	if len(ops) != 2 || ops[0].Volume != "pv-1" || ops[1].Volume != "pv-3" {
+		t.Errorf("Expected pv-1 and pv-3 in flight, oldest first, got %+v", ops)
+	}
+	first()
+	third()
+	if ops := tracker.list(); len(ops) != 0 {
+		t.Errorf("Expected no in-flight operations, got %+v", ops)
+	}
+}
+
+func TestOperationsDisabled(t *testing.T) {
+	tracker := newOperationTracker(false)
+	if tracker != nil {
+		t.Fatalf("Expected no tracker when disabled")
+	}
+	// The disabled tracker must still be usable
+	tracker.start("provision", "pv", "default/claim", newPhaseTimer())()
+}
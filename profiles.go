@@ -0,0 +1,132 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+
+	yaml "gopkg.in/yaml.v3"
+
+	"sigs.k8s.io/sig-storage-lib-external-provisioner/v13/controller"
+
+	klog "k8s.io/klog/v2"
+)
+
+// The StorageClass parameters which override the profile's settings
+const backendParameter = "backend"
+const permParameter = "perm"
+
+// A volumeProfile is a named set of settings shared by several StorageClasses.
+// Empty values defer to the next level of configuration.
+type volumeProfile struct {
+	// The backend to provision the volumes with
+	Backend string `yaml:"backend,omitempty"`
+
+	// The (octal) permissions for the volume directories
+	Perm string `yaml:"perm,omitempty"`
+}
+
+// The contents of the HOSTPATH_PROFILES_FILE
+type profileConfig struct {
+	// The profile applied to every StorageClass, beneath its own profile
+	Default volumeProfile `yaml:"default"`
+
+	// The named profiles
+	Profiles map[string]volumeProfile `yaml:"profiles"`
+
+	// Maps StorageClass names to profile names
+	Classes map[string]string `yaml:"classes"`
+}
+
+// loadProfiles reads and validates the profiles configuration file
+func loadProfiles(path string) (*profileConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	config := &profileConfig{}
+	if err := yaml.Unmarshal(data, config); err != nil {
+		return nil, err
+	}
+	for class, profile := range config.Classes {
+		if _, ok := config.Profiles[profile]; !ok {
+			return nil, fmt.Errorf("StorageClass %s is mapped to the unknown profile [%s]", class, profile)
+		}
+	}
+	for name, profile := range config.Profiles {
+		if err := profile.validate(); err != nil {
+			return nil, fmt.Errorf("profile [%s] is not valid: %w", name, err)
+		}
+	}
+	if err := config.Default.validate(); err != nil {
+		return nil, fmt.Errorf("the default profile is not valid: %w", err)
+	}
+	return config, nil
+}
+
+func (profile volumeProfile) validate() error {
+	if profile.Backend != "" {
+		if _, ok := knownBackends[profile.Backend]; !ok {
+			return fmt.Errorf("unknown backend [%s]", profile.Backend)
+		}
+	}
+	if profile.Perm != "" {
+		if _, err := strconv.ParseUint(profile.Perm, 8, 32); err != nil {
+			return fmt.Errorf("invalid permissions [%s]: %w", profile.Perm, err)
+		}
+	}
+	return nil
+}
+
+// overlay returns the given profile with its non-empty values replaced by
+// those in the other one
+func (profile volumeProfile) overlay(other volumeProfile) volumeProfile {
+	if other.Backend != "" {
+		profile.Backend = other.Backend
+	}
+	if other.Perm != "" {
+		profile.Perm = other.Perm
+	}
+	return profile
+}
+
+// resolveProfile computes the settings for the PVC's StorageClass: the node's
+// defaults, overlaid by the default profile, the class' own profile (if it's
+// mapped to one), and finally the class' parameters
+func (p *HostPathProvisioner) resolveProfile(options controller.ProvisionOptions) (volumeProfile, error) {
+	result := volumeProfile{Backend: p.DefaultBackend}
+	className := options.StorageClass.Name
+
+	if p.profiles != nil {
+		result = result.overlay(p.profiles.Default)
+		if name, ok := p.profiles.Classes[className]; ok {
+			klog.Infof("\tStorageClass %s uses the [%s] profile", className, name)
+			result = result.overlay(p.profiles.Profiles[name])
+		}
+	}
+
+	parameters := volumeProfile{
+		Backend: options.StorageClass.Parameters[backendParameter],
+		Perm:    options.StorageClass.Parameters[permParameter],
+	}
+	if err := parameters.validate(); err != nil {
+		return result, reject(rejectInvalidParameter, fmt.Errorf("the parameters for StorageClass %s are not valid: %w", className, err))
+	}
+	return result.overlay(parameters), nil
+}
@@ -0,0 +1,147 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+// writeProfiles writes the given profiles configuration into a file, and
+// returns its path
+func writeProfiles(t *testing.T, contents string) string {
+	t.Helper()
+	file := path.Join(t.TempDir(), "profiles.yaml")
+	if err := os.WriteFile(file, []byte(contents), 0644); err != nil {
+		t.Fatalf("Failed to write the profiles: %s", err)
+	}
+	return file
+}
+
+const testProfiles = `
+default:
+  perm: "0750"
+profiles:
+  fast:
+    backend: tmpfs
+    perm: "0700"
+  shared:
+    perm: "0775"
+classes:
+  gold: fast
+  team: shared
+`
+
+func TestResolveProfile(t *testing.T) {
+	profiles, err := loadProfiles(writeProfiles(t, testProfiles))
+	if err != nil {
+		t.Fatalf("Failed to load the profiles: %s", err)
+	}
+
+	for _, test := range []struct {
+		name       string
+		class      string
+		parameters map[string]string
+		expected   volumeProfile
+	}{
+		{
+			name:     "mapped class",
+			class:    "gold",
+			expected: volumeProfile{Backend: tmpfsBackendName, Perm: "0700"},
+		},
+		{
+			name:     "mapped class inheriting from the node",
+			class:    "team",
+			expected: volumeProfile{Backend: directoryBackendName, Perm: "0775"},
+		},
+		{
+			name:       "mapped class with parameter overrides",
+			class:      "gold",
+			parameters: map[string]string{backendParameter: directoryBackendName, permParameter: "0711"},
+			expected:   volumeProfile{Backend: directoryBackendName, Perm: "0711"},
+		},
+		{
+			name:       "mapped class with a partial override",
+			class:      "gold",
+			parameters: map[string]string{permParameter: "0711"},
+			expected:   volumeProfile{Backend: tmpfsBackendName, Perm: "0711"},
+		},
+		{
+			name:     "unmapped class",
+			class:    "standard",
+			expected: volumeProfile{Backend: directoryBackendName, Perm: "0750"},
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			p := newTestProvisioner(t)
+			p.profiles = profiles
+			options := testOptions("pv", testClaim("claim", nil), testClass(test.class, test.parameters))
+			profile, err := p.resolveProfile(options)
+			if err != nil {
+				t.Fatalf("Failed to resolve the profile: %s", err)
+			}
+			if profile != test.expected {
+				t.Errorf("Expected the profile %+v, got %+v", test.expected, profile)
+			}
+		})
+	}
+}
+
+func TestResolveProfileWithoutConfig(t *testing.T) {
+	p := newTestProvisioner(t)
+	options := testOptions("pv", testClaim("claim", nil), testClass("gold", map[string]string{permParameter: "0700"}))
+	profile, err := p.resolveProfile(options)
+	if err != nil {
+		t.Fatalf("Failed to resolve the profile: %s", err)
+	}
+	if expected := (volumeProfile{Backend: directoryBackendName, Perm: "0700"}); profile != expected {
+		t.Errorf("Expected the profile %+v, got %+v", expected, profile)
+	}
+}
+
+func TestLoadProfilesInvalid(t *testing.T) {
+	for name, test := range map[string]struct {
+		contents string
+		fails    string
+	}{
+		"unknown profile": {
+			contents: "classes:\n  gold: missing\n",
+			fails:    "unknown profile [missing]",
+		},
+		"unknown backend": {
+			contents: "profiles:\n  fast:\n    backend: zfs\n",
+			fails:    "unknown backend [zfs]",
+		},
+		"invalid permissions": {
+			contents: "profiles:\n  fast:\n    perm: \"0999\"\n",
+			fails:    "invalid permissions [0999]",
+		},
+		"invalid default": {
+			contents: "default:\n  backend: zfs\n",
+			fails:    "the default profile is not valid",
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			_, err := loadProfiles(writeProfiles(t, test.contents))
+			if err == nil || !strings.Contains(err.Error(), test.fails) {
+				t.Errorf("Expected the profiles to be rejected with [%s], got %v", test.fails, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,350 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"syscall"
+	"unsafe"
+
+	"sigs.k8s.io/sig-storage-lib-external-provisioner/v13/controller"
+
+	v1 "k8s.io/api/core/v1"
+	klog "k8s.io/klog/v2"
+)
+
+const quotaBackendName = "quota"
+
+// The PV annotation recording the project ID the quota backend assigned
+const quotaProjectAnnotation = "hostpath/quota-project"
+
+// The ioctls (and the flag) for a file's extended attributes, from linux/fs.h
+const fsIocFsGetXattr = 0x801c581f
+const fsIocFsSetXattr = 0x401c5820
+const fsXflagProjInherit = 0x200
+
+// The quotactl_fd() system call and its arguments, from linux/quota.h
+const sysQuotactlFd = 443
+const qSetQuota = 0x800008
+const prjQuota = 2
+const qifBLimits = 1
+const qifDqblkSize = 1024
+
+// The largest project ID handed out (project IDs are 32 bits, but some tools
+// treat them as signed)
+const maxProjectID = 0x7fffffff
+
+// struct fsxattr
+type fsxattr struct {
+	xflags     uint32
+	extsize    uint32
+	nextents   uint32
+	projid     uint32
+	cowextsize uint32
+	pad        [8]byte
+}
+
+// struct if_dqblk
+type ifDqblk struct {
+	bhardlimit uint64
+	bsoftlimit uint64
+	curspace   uint64
+	ihardlimit uint64
+	isoftlimit uint64
+	curinodes  uint64
+	btime      uint64
+	itime      uint64
+	valid      uint32
+}
+
+func xattrIoctl(path string, request uintptr, attr *fsxattr) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, file.Fd(), request, uintptr(unsafe.Pointer(attr))); errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// fsGetProjectID returns the project ID of the given file (0 = none), and
+// whether it's flagged so everything created within it inherits the project
+func fsGetProjectID(path string) (uint32, bool, error) {
+	var attr fsxattr
+	if err := xattrIoctl(path, fsIocFsGetXattr, &attr); err != nil {
+		return 0, false, err
+	}
+	return attr.projid, attr.xflags&fsXflagProjInherit != 0, nil
+}
+
+// fsSetProjectID assigns the given project ID to the given file, and flags it
+// (or not) so everything later created within it (if it's a directory)
+// inherits the project
+func fsSetProjectID(path string, id uint32, inherit bool) error {
+	var attr fsxattr
+	if err := xattrIoctl(path, fsIocFsGetXattr, &attr); err != nil {
+		return err
+	}
+	attr.projid = id
+	if inherit {
+		attr.xflags |= fsXflagProjInherit
+	} else {
+		attr.xflags &^= fsXflagProjInherit
+	}
+	return xattrIoctl(path, fsIocFsSetXattr, &attr)
+}
+
+// fsSetProjectQuota limits the given project's usage, on the file system holding
+// the given path, to the given number of bytes (0 = unlimited)
+func fsSetProjectQuota(path string, id uint32, bytes int64) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	quota := ifDqblk{
+		bhardlimit: uint64((bytes + qifDqblkSize - 1) / qifDqblkSize),
+		valid:      qifBLimits,
+	}
+	quota.bsoftlimit = quota.bhardlimit
+	cmd := uintptr(qSetQuota<<8 | prjQuota)
+	if _, _, errno := syscall.Syscall6(sysQuotactlFd, file.Fd(), cmd, uintptr(id), uintptr(unsafe.Pointer(&quota)), 0, 0); errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+var getProjectID = fsGetProjectID
+var setProjectID = fsSetProjectID
+var setProjectQuota = fsSetProjectQuota
+
+// projectIDFor derives the preferred project ID for the named volume. It's
+// derived rather than allocated so a retried provisioning operation gets the
+// same one without having to keep track of it.
+func projectIDFor(volumeName string) uint32 {
+	hash := fnv.New32a()
+	hash.Write([]byte(volumeName))
+	// Steer clear of 0, which means "no project"
+	return hash.Sum32()&maxProjectID | 1
+}
+
+// quotaBackend keeps the volume a plain directory, but assigns it a project of
+// its own with a project quota sized after the PVC's request. The volume
+// directory's file system must have project quotas enabled (i.e. XFS mounted
+// with prjquota, or ext4 with the project and quota features).
+type quotaBackend struct {
+	// Lists the provisioner's volumes, whose projects are off limits (if nil,
+	// only the parent directory's project is)
+	ownedVolumes func(ctx context.Context) ([]*v1.PersistentVolume, error)
+
+	// Restores the projects Provision changed, for when the provisioning is
+	// rolled back (the directory may remain, i.e. if a previous attempt left it
+	// behind)
+	restore func() error
+}
+
+// allocateProjectID picks the project ID for the named volume: the one derived
+// from its name, unless that's taken (i.e. by another volume whose name hashes
+// the same), in which case the next free one after it. The parent directory's
+// project is taken too, as that's the one a new directory inherits.
+func (b *quotaBackend) allocateProjectID(ctx context.Context, volumeName string, finalPath string) (uint32, error) {
+	taken := map[uint32]bool{}
+	parent, _, err := getProjectID(filepath.Dir(finalPath))
+	if err != nil {
+		return 0, fmt.Errorf("failed to read the project ID of [%s]: %w", filepath.Dir(finalPath), err)
+	}
+	if parent != 0 {
+		taken[parent] = true
+	}
+	if b.ownedVolumes != nil {
+		volumes, err := b.ownedVolumes(ctx)
+		if err != nil {
+			return 0, fmt.Errorf("failed to list the projects already in use: %w", err)
+		}
+		for _, volume := range volumes {
+			if volume.Name == volumeName {
+				continue
+			}
+			if id, err := strconv.ParseUint(volume.Annotations[quotaProjectAnnotation], 10, 32); err == nil {
+				taken[uint32(id)] = true
+			}
+		}
+	}
+
+	id := projectIDFor(volumeName)
+	for taken[id] {
+		id = id%maxProjectID + 1
+	}
+	return id, nil
+}
+
+func (b *quotaBackend) Provision(ctx context.Context, options controller.ProvisionOptions, finalPath string, permissions os.FileMode) (map[string]string, error) {
+	reserve, err := parseMetadataReserve(options.StorageClass.Parameters[metadataReserveParameter])
+	if err != nil {
+		return nil, reject(rejectInvalidParameter, fmt.Errorf("StorageClass %s is not valid: %w", options.StorageClass.Name, err))
+	}
+
+	id, err := b.allocateProjectID(ctx, options.PVName, finalPath)
+	if err != nil {
+		return nil, err
+	}
+	existing, _, err := getProjectID(finalPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the project ID of [%s]: %w", finalPath, err)
+	}
+	var restore func() error
+	if existing == id {
+		// A previous attempt already got this far
+		klog.Infof("\t[%s] already belongs to project %d", finalPath, id)
+	} else {
+		// The directory may be a plain one left behind by a previous attempt
+		// (i.e. before this backend was enabled), or one which inherited its
+		// parent's project, so anything already within it must be brought into
+		// the project too, for its usage to be counted
+		if existing != 0 {
+			klog.Infof("\t[%s] belongs to project %d, assigning it to project %d instead", finalPath, existing, id)
+		} else {
+			klog.Infof("\tAssigning [%s] to project %d", finalPath, id)
+		}
+		restore, err = assignProject(finalPath, id)
+		if err != nil {
+			return nil, fmt.Errorf("failed to assign [%s] to project %d: %w", finalPath, id, err)
+		}
+	}
+
+	annotations := map[string]string{
+		quotaProjectAnnotation: strconv.FormatUint(uint64(id), 10),
+	}
+	var size int64
+	if request, ok := options.PVC.Spec.Resources.Requests[v1.ResourceStorage]; ok {
+		size = enforcedSize(request.Value(), reserve)
+		if size != request.Value() {
+			klog.Infof("\tReserving %g%% for metadata, project %d will hold %d bytes for a request of %d", reserve, id, size, request.Value())
+			annotations[enforcedSizeAnnotation] = strconv.FormatInt(size, 10)
+		}
+	}
+	klog.Infof("\tLimiting project %d to %d bytes", id, size)
+	if err := setProjectQuota(finalPath, id, size); err != nil {
+		// The directory mustn't be left in a project without a quota (i.e. if
+		// project quotas aren't enabled)
+		if restore != nil {
+			klog.Infof("\tRestoring the previous projects within [%s]", finalPath)
+			if err := restore(); err != nil {
+				klog.Warningf("\tFailed to restore the previous projects within [%s]: %s", finalPath, err)
+			}
+		}
+		return nil, fmt.Errorf("failed to set the quota for project %d (are project quotas enabled for [%s]?): %w", id, finalPath, err)
+	}
+	b.restore = restore
+	return annotations, nil
+}
+
+// A file's project before assignProject changed it
+type previousProject struct {
+	path    string
+	id      uint32
+	inherit bool
+}
+
+// assignProject assigns the given directory and everything within it to the
+// given project. The directory itself goes last, so that if it has a project
+// then so does everything within it. The returned function restores the
+// projects they had before (the directory first, for the same reason). If the
+// assignment fails partway through, they're restored already.
+func assignProject(dir string, id uint32) (func() error, error) {
+	var entries []fs.DirEntry
+	var paths []string
+	err := filepath.WalkDir(dir, func(name string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		// Symbolic links can't be opened to get to their attributes
+		if entry.Type()&fs.ModeSymlink == 0 {
+			entries = append(entries, entry)
+			paths = append(paths, name)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	slices.Reverse(entries)
+	slices.Reverse(paths)
+
+	var previous []previousProject
+	restore := func() error {
+		var errs []error
+		for i := len(previous) - 1; i >= 0; i-- {
+			if err := setProjectID(previous[i].path, previous[i].id, previous[i].inherit); err != nil {
+				errs = append(errs, err)
+			}
+		}
+		return errors.Join(errs...)
+	}
+	for i, name := range paths {
+		oldID, oldInherit, err := getProjectID(name)
+		if err == nil {
+			err = setProjectID(name, id, entries[i].IsDir())
+		}
+		if err != nil {
+			if restoreErr := restore(); restoreErr != nil {
+				klog.Warningf("\tFailed to restore the previous projects within [%s]: %s", dir, restoreErr)
+			}
+			return nil, err
+		}
+		previous = append(previous, previousProject{path: name, id: oldID, inherit: oldInherit})
+	}
+	return restore, nil
+}
+
+// Release lifts the quota for the project recorded on the PV. The directory's
+// own project isn't to be trusted for this, as it may have been inherited from
+// another project's directory (i.e. if it was never assigned one of its own).
+// When rolling back a failed provisioning, the projects it changed are also
+// restored.
+func (b *quotaBackend) Release(ctx context.Context, fullPath string, annotations map[string]string) error {
+	value, ok := annotations[quotaProjectAnnotation]
+	if !ok {
+		klog.Warningf("\tNo project was recorded for [%s], leaving the quotas alone", fullPath)
+		return nil
+	}
+	id, err := strconv.ParseUint(value, 10, 32)
+	if err != nil || id == 0 {
+		return fmt.Errorf("the project [%s] recorded for [%s] is not valid", value, fullPath)
+	}
+	klog.Infof("\tLifting the quota for project %d at [%s]", id, fullPath)
+	if err := setProjectQuota(fullPath, uint32(id), 0); err != nil {
+		return err
+	}
+	if b.restore != nil {
+		klog.Infof("\tRestoring the previous projects within [%s]", fullPath)
+		restore := b.restore
+		b.restore = nil
+		return restore()
+	}
+	return nil
+}
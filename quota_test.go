@@ -0,0 +1,410 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// fakeProjects stands in for the file system's project IDs and quotas, which
+// need a file system with project quotas enabled (and the privileges to set
+// them). Files without a project of their own get the one they'd have
+// inherited when they were created, from the nearest directory that has one.
+type fakeProjects struct {
+	ids     map[string]uint32
+	inherit map[string]bool
+	limits  map[uint32]int64
+
+	// The number of files assigned to a project so far
+	assigned int
+
+	// The errors to fail the assignment of the given file, and the quotas, with
+	assignErr map[string]error
+	quotaErr  error
+}
+
+func stubProjects(t *testing.T) *fakeProjects {
+	f := &fakeProjects{ids: map[string]uint32{}, inherit: map[string]bool{}, limits: map[uint32]int64{}, assignErr: map[string]error{}}
+	oldGet, oldSet, oldQuota := getProjectID, setProjectID, setProjectQuota
+	t.Cleanup(func() {
+		getProjectID, setProjectID, setProjectQuota = oldGet, oldSet, oldQuota
+	})
+	getProjectID = func(path string) (uint32, bool, error) {
+		info, err := os.Stat(path)
+		if err != nil {
+			return 0, false, err
+		}
+		id, inherit := f.project(path, info.IsDir())
+		return id, inherit, nil
+	}
+	setProjectID = func(path string, id uint32, inherit bool) error {
+		if err := f.assignErr[path]; err != nil {
+			return err
+		}
+		f.ids[path] = id
+		f.inherit[path] = inherit
+		f.assigned++
+		return nil
+	}
+	setProjectQuota = func(path string, id uint32, bytes int64) error {
+		if f.quotaErr != nil {
+			return f.quotaErr
+		}
+		f.limits[id] = bytes
+		return nil
+	}
+	return f
+}
+
+// project returns the given file's project and inheritance flag: its own, or
+// those inherited from the nearest directory with a project (if it's flagged
+// for inheritance, which directories inherit too)
+func (f *fakeProjects) project(name string, dir bool) (uint32, bool) {
+	if id, ok := f.ids[name]; ok {
+		return id, f.inherit[name]
+	}
+	for parent := filepath.Dir(name); ; parent = filepath.Dir(parent) {
+		if id, ok := f.ids[parent]; ok {
+			if f.inherit[parent] {
+				return id, dir
+			}
+			return 0, false
+		}
+		if filepath.Dir(parent) == parent {
+			return 0, false
+		}
+	}
+}
+
+func TestQuotaUpgradeOnRetry(t *testing.T) {
+	p := newTestProvisioner(t)
+	p.MarkerFile = ".hostpath-marker"
+	p.Backends = []string{directoryBackendName, quotaBackendName}
+	projects := stubProjects(t)
+	options := testOptions("pv", testClaim("claim", nil), testClass("standard", nil))
+
+	// The first attempt ran before the quota backend was the default, and left a
+	// plain directory, which has since been written to
+	if _, _, err := p.Provision(context.Background(), options); err != nil {
+		t.Fatalf("The first attempt failed: %s", err)
+	}
+	volumePath := path.Join(p.HostPathMount, "pv")
+	if err := os.MkdirAll(path.Join(volumePath, "subdir"), 0755); err != nil {
+		t.Fatalf("Failed to create the volume's contents: %s", err)
+	}
+	for _, name := range []string{"data", "subdir/data"} {
+		if err := os.WriteFile(path.Join(volumePath, name), []byte(name), 0644); err != nil {
+			t.Fatalf("Failed to create the volume's contents: %s", err)
+		}
+	}
+	if projects.assigned != 0 {
+		t.Fatalf("The plain directory was assigned to a project")
+	}
+
+	p.DefaultBackend = quotaBackendName
+	volume, _, err := p.Provision(context.Background(), options)
+	if err != nil {
+		t.Fatalf("The retry failed: %s", err)
+	}
+	id := projectIDFor("pv")
+	if volume.Annotations[backendAnnotation] != quotaBackendName || volume.Annotations[quotaProjectAnnotation] != strconv.FormatUint(uint64(id), 10) {
+		t.Errorf("The quota wasn't recorded: %v", volume.Annotations)
+	}
+	for _, name := range []string{"", "subdir", "data", "subdir/data", p.MarkerFile} {
+		file := path.Join(volumePath, name)
+		if projects.ids[file] != id {
+			t.Errorf("[%s] wasn't assigned to project %d", file, id)
+		}
+		info, err := os.Stat(file)
+		if err != nil {
+			t.Fatalf("Failed to stat [%s]: %s", file, err)
+		}
+		if projects.inherit[file] != info.IsDir() {
+			t.Errorf("Expected [%s] to be flagged for inheritance only if it's a directory", file)
+		}
+	}
+	if projects.limits[id] != 1<<30 {
+		t.Errorf("Expected project %d to be limited to the request, got %d bytes", id, projects.limits[id])
+	}
+	if data, err := os.ReadFile(path.Join(volumePath, "subdir/data")); err != nil || string(data) != "subdir/data" {
+		t.Errorf("The existing contents were altered: [%s] (%v)", data, err)
+	}
+
+	// Further retries needn't walk the directory again, but do apply the limit
+	assigned := projects.assigned
+	projects.limits[id] = 0
+	if _, _, err := p.Provision(context.Background(), options); err != nil {
+		t.Fatalf("The second retry failed: %s", err)
+	}
+	if projects.assigned != assigned {
+		t.Errorf("The directory was assigned to its project again")
+	}
+	if projects.limits[id] != 1<<30 {
+		t.Errorf("The limit wasn't reapplied on the retry")
+	}
+
+	if err := p.Delete(context.Background(), volume); err != nil {
+		t.Fatalf("Deletion failed: %s", err)
+	}
+	if projects.limits[id] != 0 {
+		t.Errorf("The quota for project %d wasn't lifted", id)
+	}
+	if _, err := os.Stat(volumePath); !os.IsNotExist(err) {
+		t.Errorf("The volume wasn't removed: %v", err)
+	}
+}
+
+func TestProjectIDFor(t *testing.T) {
+	for _, name := range []string{"pv", "pvc-0b5a2c4e-1f1e-4f5a-9a8d-6c2d8e0f1a2b", ""} {
+		id := projectIDFor(name)
+		if id == 0 || id > 0x7fffffff {
+			t.Errorf("The project ID %d for [%s] is out of range", id, name)
+		}
+		if projectIDFor(name) != id {
+			t.Errorf("The project ID for [%s] isn't stable", name)
+		}
+	}
+}
+
+func TestMarkerRemovedOnRetry(t *testing.T) {
+	for _, test := range []struct {
+		name     string
+		contents []string
+		mounts   bool
+	}{
+		{name: "only the marker", mounts: true},
+		{name: "marker and data", contents: []string{"data"}},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			p := newTestProvisioner(t)
+			p.MarkerFile = ".hostpath-marker"
+			p.Backends = []string{tmpfsBackendName}
+			p.DefaultBackend = tmpfsBackendName
+			mounts := stubMountTable(t)
+			volumePath := path.Join(p.HostPathMount, "pv")
+			if err := os.Mkdir(volumePath, 0755); err != nil {
+				t.Fatalf("Failed to create the volume directory: %s", err)
+			}
+			for _, name := range append(test.contents, p.MarkerFile) {
+				if err := os.WriteFile(path.Join(volumePath, name), []byte(name), 0644); err != nil {
+					t.Fatalf("Failed to create the volume's contents: %s", err)
+				}
+			}
+
+			_, _, err := p.Provision(context.Background(), testOptions("pv", testClaim("claim", nil), testClass("standard", nil)))
+			if !test.mounts {
+				if err == nil {
+					t.Fatalf("Expected the tmpfs not to be mounted over the existing data")
+				}
+				// Nothing within the directory is touched
+				for _, name := range append(test.contents, p.MarkerFile) {
+					if _, err := os.Stat(path.Join(volumePath, name)); err != nil {
+						t.Errorf("[%s] was removed: %s", name, err)
+					}
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Provisioning failed: %s", err)
+			}
+			if len(mounts.mounts) != 1 || mounts.mounts[0].target != volumePath {
+				t.Errorf("Expected a tmpfs mounted at [%s], got %+v", volumePath, mounts.mounts)
+			}
+		})
+	}
+}
+
+func TestQuotaReleaseRecordedProject(t *testing.T) {
+	for _, test := range []struct {
+		name     string
+		recorded string
+		lifted   uint32
+		fails    bool
+	}{
+		{name: "recorded", recorded: "42", lifted: 42},
+		{name: "not recorded"},
+		{name: "invalid", recorded: "project", fails: true},
+		{name: "zero", recorded: "0", fails: true},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			p := newTestProvisioner(t)
+			p.Backends = []string{quotaBackendName}
+			projects := stubProjects(t)
+			volume := testVolume(t, p, "pv", "pv")
+			volume.Annotations[backendAnnotation] = quotaBackendName
+			if test.recorded != "" {
+				volume.Annotations[quotaProjectAnnotation] = test.recorded
+			}
+
+			// The directory belongs to another project (i.e. it inherited its
+			// parent's), whose quota must be left alone
+			volumePath := path.Join(p.HostPathMount, "pv")
+			projects.ids[volumePath] = 7
+			projects.limits[7] = 1 << 30
+			projects.limits[42] = 1 << 30
+
+			err := p.Delete(context.Background(), volume)
+			if test.fails {
+				if err == nil {
+					t.Fatalf("Expected the deletion to fail")
+				}
+				if _, err := os.Stat(volumePath); err != nil {
+					t.Errorf("The volume was removed despite the failure: %s", err)
+				}
+			} else if err != nil {
+				t.Fatalf("Deletion failed: %s", err)
+			}
+			for id, limit := range projects.limits {
+				if lifted := id == test.lifted; lifted != (limit == 0) {
+					t.Errorf("Expected only the quota for project %d to be lifted, got %v", test.lifted, projects.limits)
+				}
+			}
+		})
+	}
+}
+
+func TestQuotaInheritedProject(t *testing.T) {
+	for _, test := range []struct {
+		name   string
+		parent uint32
+	}{
+		{name: "class quota", parent: 500},
+		// The parent's project happens to be the one derived for the volume
+		{name: "same as derived", parent: projectIDFor("pv")},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			p := newTestProvisioner(t)
+			p.Backends = []string{quotaBackendName}
+			p.DefaultBackend = quotaBackendName
+			projects := stubProjects(t)
+
+			// The volume is created within a directory with a quota of its own,
+			// whose project it inherits
+			parentPath := path.Join(p.HostPathMount, "shared")
+			if err := os.Mkdir(parentPath, 0755); err != nil {
+				t.Fatalf("Failed to create the parent directory: %s", err)
+			}
+			projects.ids[parentPath] = test.parent
+			projects.inherit[parentPath] = true
+			projects.limits[test.parent] = 10 << 30
+
+			claim := testClaim("claim", map[string]string{locationAnnotation: "shared/pv"})
+			options := testOptions("pv", claim, testClass("standard", nil))
+			volume, _, err := p.Provision(context.Background(), options)
+			if err != nil {
+				t.Fatalf("Provisioning failed: %s", err)
+			}
+			volumePath := path.Join(parentPath, "pv")
+			id := projects.ids[volumePath]
+			if id == 0 || id == test.parent {
+				t.Fatalf("Expected [%s] to get a project of its own, got %d", volumePath, id)
+			}
+			if volume.Annotations[quotaProjectAnnotation] != strconv.FormatUint(uint64(id), 10) {
+				t.Errorf("Expected the project %d to be recorded, got %v", id, volume.Annotations)
+			}
+			if projects.limits[test.parent] != 10<<30 || projects.limits[id] != 1<<30 {
+				t.Errorf("Expected only the volume's own project to be limited to the request, got %v", projects.limits)
+			}
+
+			// Retries keep the project
+			if _, _, err := p.Provision(context.Background(), options); err != nil {
+				t.Fatalf("The retry failed: %s", err)
+			}
+			if projects.ids[volumePath] != id {
+				t.Errorf("The retry moved [%s] from project %d to %d", volumePath, id, projects.ids[volumePath])
+			}
+
+			if err := p.Delete(context.Background(), volume); err != nil {
+				t.Fatalf("Deletion failed: %s", err)
+			}
+			if projects.limits[test.parent] != 10<<30 || projects.limits[id] != 0 {
+				t.Errorf("Expected only the volume's own quota to be lifted, got %v", projects.limits)
+			}
+		})
+	}
+}
+
+func TestQuotaProjectCollision(t *testing.T) {
+	p := newTestProvisioner(t)
+	p.Backends = []string{quotaBackendName}
+	p.DefaultBackend = quotaBackendName
+	projects := stubProjects(t)
+	ctx := context.Background()
+
+	// Another volume already has the project derived for this one (i.e. their
+	// names hash the same)
+	derived := projectIDFor("pv")
+	other := testVolume(t, p, "pv-other", "pv-other")
+	other.Annotations[backendAnnotation] = quotaBackendName
+	other.Annotations[quotaProjectAnnotation] = strconv.FormatUint(uint64(derived), 10)
+	if _, err := p.Client.CoreV1().PersistentVolumes().Create(ctx, other, metav1.CreateOptions{}); err != nil {
+		t.Fatalf("Failed to create the PV: %s", err)
+	}
+	projects.ids[path.Join(p.HostPathMount, "pv-other")] = derived
+	projects.limits[derived] = 5 << 30
+
+	options := testOptions("pv", testClaim("claim", nil), testClass("standard", nil))
+	volume, _, err := p.Provision(ctx, options)
+	if err != nil {
+		t.Fatalf("Provisioning failed: %s", err)
+	}
+	id := projects.ids[path.Join(p.HostPathMount, "pv")]
+	if id == derived || id == 0 {
+		t.Fatalf("Expected a project other than %d, got %d", derived, id)
+	}
+	if volume.Annotations[quotaProjectAnnotation] != strconv.FormatUint(uint64(id), 10) {
+		t.Errorf("Expected the project %d to be recorded, got %v", id, volume.Annotations)
+	}
+	if projects.limits[derived] != 5<<30 {
+		t.Errorf("The other volume's quota was changed: %v", projects.limits)
+	}
+
+	// The volume's own PV (i.e. from an earlier, interrupted attempt) doesn't
+	// count against it
+	if _, err := p.Client.CoreV1().PersistentVolumes().Create(ctx, volume, metav1.CreateOptions{}); err != nil {
+		t.Fatalf("Failed to create the PV: %s", err)
+	}
+	if _, _, err := p.Provision(ctx, options); err != nil {
+		t.Fatalf("The retry failed: %s", err)
+	}
+	if got := projects.ids[path.Join(p.HostPathMount, "pv")]; got != id {
+		t.Errorf("The retry moved the volume from project %d to %d", id, got)
+	}
+}
+
+func TestQuotaProjectListingFails(t *testing.T) {
+	p := newTestProvisioner(t)
+	p.Backends = []string{quotaBackendName}
+	p.DefaultBackend = quotaBackendName
+	projects := stubProjects(t)
+	failAPI(p, "list", "persistentvolumes")
+
+	// Without knowing which projects are taken, none is assigned
+	if _, _, err := p.Provision(context.Background(), testOptions("pv", testClaim("claim", nil), testClass("standard", nil))); err == nil {
+		t.Fatalf("Expected the provisioning to fail")
+	}
+	if projects.assigned != 0 || len(projects.limits) != 0 {
+		t.Errorf("Expected no project to be assigned, got %v (limits %v)", projects.ids, projects.limits)
+	}
+}
@@ -0,0 +1,170 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"syscall"
+	"time"
+
+	klog "k8s.io/klog/v2"
+)
+
+// How long the API connectivity check may take before it's considered failed
+const apiCheckTimeout = 5 * time.Second
+
+// The outcome of a single readiness check
+type readinessCheck struct {
+	Name    string `json:"name"`
+	Ok      bool   `json:"ok"`
+	Message string `json:"message"`
+}
+
+// The detailed readiness payload served by /readyz
+type readinessReport struct {
+	Ready  bool             `json:"ready"`
+	Checks []readinessCheck `json:"checks"`
+}
+
+// inMaintenance returns true if the maintenance file is configured and present
+func (p *HostPathProvisioner) inMaintenance() bool {
+	if p.MaintenanceFile == "" {
+		return false
+	}
+	_, err := os.Stat(p.MaintenanceFile)
+	return err == nil
+}
+
+func (p *HostPathProvisioner) checkPVDirExists() readinessCheck {
+	check := readinessCheck{Name: "pvDirExists"}
+	info, err := os.Stat(p.HostPathMount)
+	switch {
+	case err != nil:
+		check.Message = err.Error()
+	case !info.IsDir():
+		check.Message = fmt.Sprintf("[%s] is not a directory", p.HostPathMount)
+	default:
+		check.Ok = true
+		check.Message = fmt.Sprintf("[%s] exists", p.HostPathMount)
+	}
+	return check
+}
+
+func (p *HostPathProvisioner) checkPVDirWritable() readinessCheck {
+	check := readinessCheck{Name: "pvDirWritable"}
+	probe, err := os.CreateTemp(p.HostPathMount, ".readyz.")
+	if err != nil {
+		check.Message = err.Error()
+		return check
+	}
+	probe.Close()
+	os.Remove(probe.Name())
+	check.Ok = true
+	check.Message = fmt.Sprintf("[%s] is writable", p.HostPathMount)
+	return check
+}
+
+func (p *HostPathProvisioner) checkAPIConnected(ctx context.Context) readinessCheck {
+	check := readinessCheck{Name: "apiConnected"}
+	if p.Client == nil {
+		check.Message = "no API client is configured"
+		return check
+	}
+	ctx, cancel := context.WithTimeout(ctx, apiCheckTimeout)
+	defer cancel()
+	result := p.Client.Discovery().RESTClient().Get().AbsPath("/version").Do(ctx)
+	if err := result.Error(); err != nil {
+		check.Message = err.Error()
+		return check
+	}
+	check.Ok = true
+	check.Message = "the API server is reachable"
+	return check
+}
+
+func (p *HostPathProvisioner) checkNotInMaintenance() readinessCheck {
+	check := readinessCheck{Name: "notInMaintenance", Ok: true, Message: "not in maintenance"}
+	if p.inMaintenance() {
+		check.Ok = false
+		check.Message = fmt.Sprintf("the maintenance file [%s] is present", p.MaintenanceFile)
+	}
+	return check
+}
+
+func (p *HostPathProvisioner) checkDiskNotFull() readinessCheck {
+	check := readinessCheck{Name: "diskNotFull"}
+	var stat syscall.Statfs_t
+	if err := statfs(p.HostPathMount, &stat); err != nil {
+		check.Message = err.Error()
+		return check
+	}
+	if err := capacityError(p.HostPathMount, stat); err != nil {
+		check.Message = err.Error()
+		return check
+	}
+	check.Ok = true
+	check.Message = fmt.Sprintf("%d bytes and %d inodes free on [%s]", stat.Bavail*uint64(stat.Bsize), stat.Ffree, p.HostPathMount)
+	return check
+}
+
+// checkReadiness runs all the readiness checks, in order
+func (p *HostPathProvisioner) checkReadiness(ctx context.Context) readinessReport {
+	report := readinessReport{
+		Checks: []readinessCheck{
+			p.checkPVDirExists(),
+			p.checkPVDirWritable(),
+			p.checkAPIConnected(ctx),
+			p.checkNotInMaintenance(),
+			p.checkDiskNotFull(),
+		},
+	}
+	report.Ready = true
+	for _, check := range report.Checks {
+		if !check.Ok {
+			report.Ready = false
+		}
+	}
+	p.status.ready(report.Ready)
+	return report
+}
+
+// serveReadiness handles /readyz: the status code reflects the overall readiness,
+// and the body carries the individual checks' results if so configured
+func (p *HostPathProvisioner) serveReadiness(w http.ResponseWriter, r *http.Request) {
+	report := p.checkReadiness(r.Context())
+	status := http.StatusOK
+	if !report.Ready {
+		status = http.StatusServiceUnavailable
+	}
+
+	if !p.ReadinessDetail {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.WriteHeader(status)
+		fmt.Fprintln(w, http.StatusText(status))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(report); err != nil {
+		klog.Warningf("Failed to write the readiness report: %s", err)
+	}
+}
@@ -0,0 +1,175 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"slices"
+	"syscall"
+	"testing"
+
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+)
+
+// stubStatfs makes statfs report the given free blocks and inodes, until the
+// test is done
+func stubStatfs(t *testing.T, blocksFree uint64, inodesFree uint64) {
+	t.Helper()
+	statfs = func(path string, stat *syscall.Statfs_t) error {
+		*stat = syscall.Statfs_t{Bsize: 4096, Blocks: 1000, Bavail: blocksFree, Files: 1000, Ffree: inodesFree}
+		return nil
+	}
+	t.Cleanup(func() { statfs = syscall.Statfs })
+}
+
+// newAPIServer serves /version with the given status code, returning a client
+// connected to it
+func newAPIServer(t *testing.T, status int) kubernetes.Interface {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		w.Write([]byte(`{"major": "1", "minor": "36"}`))
+	}))
+	t.Cleanup(server.Close)
+	client, err := kubernetes.NewForConfig(&rest.Config{Host: server.URL})
+	if err != nil {
+		t.Fatalf("Failed to create the client: %s", err)
+	}
+	return client
+}
+
+func TestReadinessReport(t *testing.T) {
+	tests := []struct {
+		name    string
+		breakIt func(t *testing.T, p *HostPathProvisioner)
+		failing []string
+	}{
+		{
+			name:    "healthy",
+			breakIt: func(t *testing.T, p *HostPathProvisioner) {},
+		},
+		{
+			name: "missing",
+			breakIt: func(t *testing.T, p *HostPathProvisioner) {
+				p.HostPathMount = path.Join(p.HostPathMount, "missing")
+			},
+			// Nothing can be written to a missing directory either
+			failing: []string{"pvDirExists", "pvDirWritable"},
+		},
+		{
+			name: "read-only",
+			breakIt: func(t *testing.T, p *HostPathProvisioner) {
+				// Not even root may create files here
+				p.HostPathMount = "/proc"
+			},
+			failing: []string{"pvDirWritable"},
+		},
+		{
+			name: "disconnected",
+			breakIt: func(t *testing.T, p *HostPathProvisioner) {
+				p.Client = newAPIServer(t, http.StatusInternalServerError)
+			},
+			failing: []string{"apiConnected"},
+		},
+		{
+			name: "maintenance",
+			breakIt: func(t *testing.T, p *HostPathProvisioner) {
+				p.MaintenanceFile = path.Join(p.PVDir, "maintenance")
+				if err := os.WriteFile(p.MaintenanceFile, nil, 0644); err != nil {
+					t.Fatalf("Failed to create the maintenance file: %s", err)
+				}
+			},
+			failing: []string{"notInMaintenance"},
+		},
+		{
+			name:    "out of space",
+			breakIt: func(t *testing.T, p *HostPathProvisioner) { stubStatfs(t, 0, 1000) },
+			failing: []string{"diskNotFull"},
+		},
+		{
+			name:    "out of inodes",
+			breakIt: func(t *testing.T, p *HostPathProvisioner) { stubStatfs(t, 1000, 0) },
+			failing: []string{"diskNotFull"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			p := newTestProvisioner(t)
+			p.ReadinessDetail = true
+			p.Client = newAPIServer(t, http.StatusOK)
+			stubStatfs(t, 1000, 1000)
+			test.breakIt(t, p)
+
+			recorder := httptest.NewRecorder()
+			p.serveReadiness(recorder, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+
+			expectedStatus := http.StatusOK
+			if len(test.failing) > 0 {
+				expectedStatus = http.StatusServiceUnavailable
+			}
+			if recorder.Code != expectedStatus {
+				t.Errorf("Expected the status %d, got %d", expectedStatus, recorder.Code)
+			}
+
+			var report readinessReport
+			if err := json.Unmarshal(recorder.Body.Bytes(), &report); err != nil {
+				t.Fatalf("Failed to parse the readiness report [%s]: %s", recorder.Body.String(), err)
+			}
+			if report.Ready != (len(test.failing) == 0) {
+				t.Errorf("Expected ready = %t, got %t", len(test.failing) == 0, report.Ready)
+			}
+			if len(report.Checks) != 5 {
+				t.Errorf("Expected all 5 checks to be reported, got %d", len(report.Checks))
+			}
+			for _, check := range report.Checks {
+				shouldFail := slices.Contains(test.failing, check.Name)
+				if check.Ok == shouldFail {
+					t.Errorf("Expected the check %s to have ok = %t, got %+v", check.Name, !shouldFail, check)
+				}
+				if check.Message == "" {
+					t.Errorf("The check %s has no message", check.Name)
+				}
+			}
+		})
+	}
+}
+
+func TestReadinessPlain(t *testing.T) {
+	p := newTestProvisioner(t)
+	p.Client = newAPIServer(t, http.StatusOK)
+	stubStatfs(t, 1000, 1000)
+	p.MaintenanceFile = path.Join(p.PVDir, "maintenance")
+	if err := os.WriteFile(p.MaintenanceFile, nil, 0644); err != nil {
+		t.Fatalf("Failed to create the maintenance file: %s", err)
+	}
+
+	recorder := httptest.NewRecorder()
+	p.serveReadiness(recorder, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	if recorder.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected the status %d, got %d", http.StatusServiceUnavailable, recorder.Code)
+	}
+	if json.Valid(recorder.Body.Bytes()) {
+		t.Errorf("Expected no JSON payload unless HOSTPATH_READINESS_DETAIL is set, got [%s]", recorder.Body.String())
+	}
+}
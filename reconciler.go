@@ -0,0 +1,167 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"os"
+	"slices"
+	"strconv"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	klog "k8s.io/klog/v2"
+)
+
+const reconcileRepairNone = "none"
+const reconcileRepairFromMarker = "marker"
+const reconcileRepairFromAnnotations = "annotations"
+
+// The annotations the provisioner itself relies on (i.e. to decide whether it
+// owns a volume, or how to clean it up), which may never be repaired from the
+// marker files
+var protectedAnnotations = []string{
+	provisionerIdentityAnnotation,
+	backendAnnotation,
+	bindSourceAnnotation,
+	readOnlyAnnotation,
+	enforcedSizeAnnotation,
+	contentHashAnnotation,
+}
+
+// runReconciler periodically compares each owned PV's annotations against the
+// marker file in its directory, until the context is cancelled
+func (p *HostPathProvisioner) runReconciler(ctx context.Context) {
+	if p.MarkerFile == "" {
+		klog.Warningf("HOSTPATH_RECONCILE_INTERVAL is set but HOSTPATH_MARKER_FILE is not, there's nothing to reconcile")
+		return
+	}
+	klog.Infof("Reconciling the marker files against the PV annotations every %s (repair = %s)", p.ReconcileInterval, p.ReconcileRepair)
+	wait.UntilWithContext(ctx, p.reconcileMarkers, p.ReconcileInterval)
+}
+
+// reconcileMarkers performs a single reconciliation pass over all owned PVs
+func (p *HostPathProvisioner) reconcileMarkers(ctx context.Context) {
+	volumes, err := p.listOwnedVolumes(ctx)
+	if err != nil {
+		if err := p.auxiliaryFailed(auxiliaryListVolumes, err); err != nil {
+			klog.Errorf("Failed to reconcile the marker files: %s", err)
+		}
+		return
+	}
+	for _, volume := range volumes {
+		// Read-only volumes expose shared data, so they get no marker
+		if volume.Annotations[readOnlyAnnotation] == "true" {
+			continue
+		}
+		if err := p.reconcileMarker(ctx, volume); err != nil {
+			klog.Warningf("Failed to reconcile the marker for volume %s: %s", volume.Name, err)
+		}
+	}
+}
+
+// reconcileMarker compares the given PV's annotations against its marker file,
+// reporting (and possibly repairing) any discrepancies
+func (p *HostPathProvisioner) reconcileMarker(ctx context.Context, volume *v1.PersistentVolume) error {
+	volumePath, err := p.volumePath(volume)
+	if err != nil {
+		return err
+	}
+
+	annotations := markerAnnotations(volume)
+	marker, err := p.readMarker(volumePath)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	var keys []string
+	if marker != nil {
+		keys = diffAnnotations(annotations, marker.Annotations)
+		if len(keys) == 0 {
+			return nil
+		}
+	}
+
+	// Every discrepancy is counted once, whether or not it gets repaired
+	repaired := false
+	defer func() {
+		markerDiscrepanciesTotal.WithLabelValues(strconv.FormatBool(repaired)).Inc()
+	}()
+
+	if marker == nil {
+		// A missing marker can only be fixed from the annotations
+		klog.Warningf("Volume %s has no marker file at [%s]", volume.Name, volumePath)
+		if p.ReconcileRepair == reconcileRepairFromAnnotations {
+			if err := p.writeMarker(volumePath, volume); err != nil {
+				return err
+			}
+			klog.Infof("\tRecreated the marker file for volume %s from its annotations", volume.Name)
+			repaired = true
+		}
+		return nil
+	}
+
+	for _, key := range keys {
+		klog.Warningf("Volume %s annotation %s differs from its marker: annotation=[%s] marker=[%s]", volume.Name, key, annotations[key], marker.Annotations[key])
+	}
+
+	switch p.ReconcileRepair {
+	case reconcileRepairFromMarker:
+		// The marker lives within the volume, where its pods can write to it, so
+		// the annotations the provisioner relies on are never taken from it
+		var protected []string
+		keys = slices.DeleteFunc(keys, func(key string) bool {
+			if slices.Contains(protectedAnnotations, key) {
+				protected = append(protected, key)
+				return true
+			}
+			return false
+		})
+		for _, key := range protected {
+			klog.Warningf("\tWon't repair the provisioner-owned annotation %s for volume %s from its marker", key, volume.Name)
+		}
+		if len(keys) == 0 {
+			return nil
+		}
+		err := p.updateVolume(ctx, volume.Name, func(updated *v1.PersistentVolume) bool {
+			if updated.Annotations == nil {
+				updated.Annotations = map[string]string{}
+			}
+			for _, key := range keys {
+				if value, ok := marker.Annotations[key]; ok {
+					updated.Annotations[key] = value
+				} else {
+					delete(updated.Annotations, key)
+				}
+			}
+			return true
+		})
+		if err != nil {
+			// The discrepancy remains, and is counted as unrepaired
+			return p.auxiliaryFailed(auxiliaryUpdateVolume, err)
+		}
+		klog.Infof("\tRepaired the annotations for volume %s from its marker", volume.Name)
+		repaired = len(protected) == 0
+	case reconcileRepairFromAnnotations:
+		if err := p.writeMarker(volumePath, volume); err != nil {
+			return err
+		}
+		klog.Infof("\tRepaired the marker for volume %s from its annotations", volume.Name)
+		repaired = true
+	}
+	return nil
+}
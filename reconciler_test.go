@@ -0,0 +1,183 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"os"
+	"path"
+	"strconv"
+	"testing"
+
+	yaml "gopkg.in/yaml.v3"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// seedMarker writes the given (possibly tampered) marker into the volume's
+// directory, and creates the PV itself
+func seedMarker(t *testing.T, p *HostPathProvisioner, volume *v1.PersistentVolume, annotations map[string]string) string {
+	t.Helper()
+	volumePath, err := p.volumePath(volume)
+	if err != nil {
+		t.Fatalf("Failed to compute the volume path: %s", err)
+	}
+	data, err := yaml.Marshal(volumeMarker{Volume: volume.Name, Annotations: annotations})
+	if err != nil {
+		t.Fatalf("Failed to marshal the marker: %s", err)
+	}
+	if err := os.WriteFile(path.Join(volumePath, p.MarkerFile), data, 0644); err != nil {
+		t.Fatalf("Failed to write the marker: %s", err)
+	}
+	if _, err := p.Client.CoreV1().PersistentVolumes().Create(context.Background(), volume, metav1.CreateOptions{}); err != nil {
+		t.Fatalf("Failed to create the PV: %s", err)
+	}
+	return volumePath
+}
+
+func newReconcileProvisioner(t *testing.T, repair string) *HostPathProvisioner {
+	p := newTestProvisioner(t)
+	p.MarkerFile = ".hostpath-marker"
+	p.ReconcileRepair = repair
+	return p
+}
+
+func TestReconcileMarkerInSync(t *testing.T) {
+	p := newReconcileProvisioner(t, reconcileRepairNone)
+	volume := testVolume(t, p, "pv-in-sync", "pv-in-sync")
+	seedMarker(t, p, volume, markerAnnotations(volume))
+
+	unrepaired := counterValue(t, markerDiscrepanciesTotal.WithLabelValues("false"))
+	repaired := counterValue(t, markerDiscrepanciesTotal.WithLabelValues("true"))
+	for range 3 {
+		if err := p.reconcileMarker(context.Background(), volume); err != nil {
+			t.Fatalf("Reconciliation failed: %s", err)
+		}
+	}
+	if got := counterValue(t, markerDiscrepanciesTotal.WithLabelValues("false")); got != unrepaired {
+		t.Errorf("An in-sync volume was counted as an unrepaired discrepancy: %v -> %v", unrepaired, got)
+	}
+	if got := counterValue(t, markerDiscrepanciesTotal.WithLabelValues("true")); got != repaired {
+		t.Errorf("An in-sync volume was counted as a repaired discrepancy: %v -> %v", repaired, got)
+	}
+}
+
+func TestReconcileMarkerMissing(t *testing.T) {
+	for _, repair := range []string{reconcileRepairNone, reconcileRepairFromAnnotations} {
+		t.Run(repair, func(t *testing.T) {
+			p := newReconcileProvisioner(t, repair)
+			volume := testVolume(t, p, "pv-missing-"+repair, "pv-missing-"+repair)
+
+			isRepaired := repair == reconcileRepairFromAnnotations
+			counter := markerDiscrepanciesTotal.WithLabelValues(strconv.FormatBool(isRepaired))
+			before := counterValue(t, counter)
+			if err := p.reconcileMarker(context.Background(), volume); err != nil {
+				t.Fatalf("Reconciliation failed: %s", err)
+			}
+			if got := counterValue(t, counter); got != before+1 {
+				t.Errorf("Expected the discrepancy to be counted once, got %v -> %v", before, got)
+			}
+
+			volumePath, _ := p.volumePath(volume)
+			_, err := p.readMarker(volumePath)
+			if isRepaired && err != nil {
+				t.Errorf("Expected the marker to be recreated: %s", err)
+			}
+			if !isRepaired && !os.IsNotExist(err) {
+				t.Errorf("Expected the marker to remain missing, got %v", err)
+			}
+		})
+	}
+}
+
+func TestReconcileMarkerRepairFromMarker(t *testing.T) {
+	p := newReconcileProvisioner(t, reconcileRepairFromMarker)
+	volume := testVolume(t, p, "pv-from-marker", "pv-from-marker")
+	volume.Annotations[ownerAnnotation] = "StatefulSet/web"
+	tampered := markerAnnotations(volume)
+	tampered[ownerAnnotation] = "StatefulSet/db"
+	seedMarker(t, p, volume, tampered)
+
+	before := counterValue(t, markerDiscrepanciesTotal.WithLabelValues("true"))
+	if err := p.reconcileMarker(context.Background(), volume); err != nil {
+		t.Fatalf("Reconciliation failed: %s", err)
+	}
+	if got := counterValue(t, markerDiscrepanciesTotal.WithLabelValues("true")); got != before+1 {
+		t.Errorf("Expected a repaired discrepancy to be counted, got %v -> %v", before, got)
+	}
+
+	updated, err := p.Client.CoreV1().PersistentVolumes().Get(context.Background(), volume.Name, metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("Failed to fetch the PV: %s", err)
+	}
+	if got := updated.Annotations[ownerAnnotation]; got != "StatefulSet/db" {
+		t.Errorf("Expected the annotation to be repaired from the marker, got [%s]", got)
+	}
+}
+
+func TestReconcileMarkerProtectedAnnotations(t *testing.T) {
+	for _, key := range protectedAnnotations {
+		t.Run(key, func(t *testing.T) {
+			p := newReconcileProvisioner(t, reconcileRepairFromMarker)
+			volume := testVolume(t, p, "pv-protected", "pv-protected")
+			volume.Annotations[ownerAnnotation] = "StatefulSet/web"
+			tampered := markerAnnotations(volume)
+			tampered[key] = "tampered"
+			tampered[ownerAnnotation] = "StatefulSet/db"
+			seedMarker(t, p, volume, tampered)
+
+			before := counterValue(t, markerDiscrepanciesTotal.WithLabelValues("false"))
+			if err := p.reconcileMarker(context.Background(), volume); err != nil {
+				t.Fatalf("Reconciliation failed: %s", err)
+			}
+			if got := counterValue(t, markerDiscrepanciesTotal.WithLabelValues("false")); got != before+1 {
+				t.Errorf("Expected a partially-repaired discrepancy to count as unrepaired, got %v -> %v", before, got)
+			}
+
+			updated, err := p.Client.CoreV1().PersistentVolumes().Get(context.Background(), volume.Name, metav1.GetOptions{})
+			if err != nil {
+				t.Fatalf("Failed to fetch the PV: %s", err)
+			}
+			if got := updated.Annotations[key]; got != volume.Annotations[key] {
+				t.Errorf("The provisioner-owned annotation %s was taken from the marker: [%s]", key, got)
+			}
+			if got := updated.Annotations[ownerAnnotation]; got != "StatefulSet/db" {
+				t.Errorf("Expected the unprotected annotation to still be repaired, got [%s]", got)
+			}
+		})
+	}
+}
+
+func TestReconcileMarkerRepairFromAnnotations(t *testing.T) {
+	p := newReconcileProvisioner(t, reconcileRepairFromAnnotations)
+	volume := testVolume(t, p, "pv-from-annotations", "pv-from-annotations")
+	tampered := markerAnnotations(volume)
+	tampered[provisionerIdentityAnnotation] = "someone-else"
+	volumePath := seedMarker(t, p, volume, tampered)
+
+	if err := p.reconcileMarker(context.Background(), volume); err != nil {
+		t.Fatalf("Reconciliation failed: %s", err)
+	}
+	marker, err := p.readMarker(volumePath)
+	if err != nil {
+		t.Fatalf("Failed to read the marker: %s", err)
+	}
+	if keys := diffAnnotations(markerAnnotations(volume), marker.Annotations); len(keys) > 0 {
+		t.Errorf("Expected the marker to match the annotations, but these differ: %v", keys)
+	}
+}
@@ -0,0 +1,65 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"errors"
+)
+
+// The reasons provisioning requests get rejected for, as reported by the
+// hostpath_provisioner_rejections_total metric
+const rejectPathTraversal = "path-traversal"
+const rejectPathNotAllowed = "path-not-allowed"
+const rejectUnsupportedMode = "unsupported-mode"
+const rejectInvalidParameter = "invalid-parameter"
+const rejectBackendUnavailable = "backend-unavailable"
+
+var rejectionReasons = []string{
+	rejectPathTraversal,
+	rejectPathNotAllowed,
+	rejectUnsupportedMode,
+	rejectInvalidParameter,
+	rejectBackendUnavailable,
+}
+
+// A rejection is an error caused by a provisioning request which failed
+// validation (as opposed to something going wrong while carrying it out)
+type rejection struct {
+	reason string
+	err    error
+}
+
+func (r *rejection) Error() string {
+	return r.err.Error()
+}
+
+func (r *rejection) Unwrap() error {
+	return r.err
+}
+
+// reject marks the given error as a rejection for the given reason
+func reject(reason string, err error) error {
+	return &rejection{reason: reason, err: err}
+}
+
+// countRejection increments the rejections metric if the given error is one
+func countRejection(err error) {
+	var r *rejection
+	if errors.As(err, &r) {
+		rejectionsTotal.WithLabelValues(r.reason).Inc()
+	}
+}
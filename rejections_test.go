@@ -0,0 +1,121 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"testing"
+
+	"sigs.k8s.io/sig-storage-lib-external-provisioner/v13/controller"
+
+	v1 "k8s.io/api/core/v1"
+)
+
+// rejectionCounts reads the rejections metric for every reason
+func rejectionCounts(t *testing.T) map[string]float64 {
+	result := map[string]float64{}
+	for _, reason := range rejectionReasons {
+		result[reason] = counterValue(t, rejectionsTotal.WithLabelValues(reason))
+	}
+	return result
+}
+
+func TestRejections(t *testing.T) {
+	for _, test := range []struct {
+		reason  string
+		prepare func(p *HostPathProvisioner, options *controller.ProvisionOptions)
+	}{
+		{
+			reason: rejectPathTraversal,
+			prepare: func(p *HostPathProvisioner, options *controller.ProvisionOptions) {
+				options.PVC.Annotations = map[string]string{locationAnnotation: "../escape"}
+			},
+		},
+		{
+			reason: rejectPathNotAllowed,
+			prepare: func(p *HostPathProvisioner, options *controller.ProvisionOptions) {
+				p.AllowedSubtrees = []string{"allowed"}
+				options.PVC.Annotations = map[string]string{locationAnnotation: "elsewhere/volume"}
+			},
+		},
+		{
+			reason: rejectUnsupportedMode,
+			prepare: func(p *HostPathProvisioner, options *controller.ProvisionOptions) {
+				p.Backends = []string{directoryBackendName, tmpfsBackendName}
+				options.StorageClass.Parameters = map[string]string{backendParameter: tmpfsBackendName}
+				options.PVC.Spec.AccessModes = []v1.PersistentVolumeAccessMode{v1.ReadOnlyMany}
+			},
+		},
+		{
+			reason: rejectInvalidParameter,
+			prepare: func(p *HostPathProvisioner, options *controller.ProvisionOptions) {
+				options.StorageClass.Parameters = map[string]string{permParameter: "0999"}
+			},
+		},
+		{
+			reason: rejectBackendUnavailable,
+			prepare: func(p *HostPathProvisioner, options *controller.ProvisionOptions) {
+				options.StorageClass.Parameters = map[string]string{backendParameter: tmpfsBackendName}
+			},
+		},
+	} {
+		t.Run(test.reason, func(t *testing.T) {
+			p := newTestProvisioner(t)
+			options := testOptions("pv", testClaim("claim", nil), testClass("standard", nil))
+			test.prepare(p, &options)
+
+			before := rejectionCounts(t)
+			_, _, err := p.Provision(context.Background(), options)
+			var rejected *rejection
+			if !errors.As(err, &rejected) || rejected.reason != test.reason {
+				t.Fatalf("Expected a rejection for [%s], got %v", test.reason, err)
+			}
+			after := rejectionCounts(t)
+			for _, reason := range rejectionReasons {
+				expected := before[reason]
+				if reason == test.reason {
+					expected++
+				}
+				if after[reason] != expected {
+					t.Errorf("Expected the [%s] count to go from %v to %v, got %v", reason, before[reason], expected, after[reason])
+				}
+			}
+		})
+	}
+}
+
+func TestFailuresNotCountedAsRejections(t *testing.T) {
+	// The request is valid, it's the file system which lets it down
+	p := newTestProvisioner(t)
+	p.ModeMismatch = modeMismatchFail
+	t.Cleanup(func() { chmod = os.Chmod })
+	chmod = func(name string, mode os.FileMode) error {
+		return os.Chmod(name, mode^0001)
+	}
+
+	before := rejectionCounts(t)
+	if _, _, err := p.Provision(context.Background(), testOptions("pv", testClaim("claim", nil), testClass("standard", nil))); err == nil {
+		t.Fatalf("Expected the provisioning to fail")
+	}
+	for reason, count := range rejectionCounts(t) {
+		if count != before[reason] {
+			t.Errorf("A failure was counted as a [%s] rejection", reason)
+		}
+	}
+}
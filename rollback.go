@@ -0,0 +1,82 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+
+	klog "k8s.io/klog/v2"
+)
+
+// A completed provisioning step, and how to undo it
+type rollbackStep struct {
+	name string
+	undo func() error
+}
+
+// rollback tracks the completed steps of a provisioning operation so that, if
+// a later step fails, the earlier ones may be undone (in reverse order) instead
+// of leaving residue behind
+type rollback struct {
+	steps []rollbackStep
+}
+
+func (r *rollback) add(name string, undo func() error) {
+	r.steps = append(r.steps, rollbackStep{name: name, undo: undo})
+}
+
+// run undoes all the completed steps, most recent first. Failures are logged,
+// but don't stop the remaining steps from being undone.
+func (r *rollback) run() {
+	for i := len(r.steps) - 1; i >= 0; i-- {
+		step := r.steps[i]
+		if err := step.undo(); err != nil {
+			klog.Warningf("\tFailed to roll back the %s step: %s", step.name, err)
+		} else {
+			klog.Infof("\tRolled back the %s step", step.name)
+		}
+	}
+	r.steps = nil
+}
+
+// missingDirs lists the given directory and its ancestors which don't exist yet,
+// deepest first: these are the ones MkdirAll would create
+func missingDirs(dir string) []string {
+	var result []string
+	for dir = filepath.Clean(dir); ; dir = filepath.Dir(dir) {
+		if _, err := os.Stat(dir); !os.IsNotExist(err) {
+			break
+		}
+		result = append(result, dir)
+		if parent := filepath.Dir(dir); parent == dir {
+			break
+		}
+	}
+	return result
+}
+
+// removeDirs removes the given (empty) directories, in order. Directories which
+// aren't empty are left alone, since something else may be using them.
+func removeDirs(dirs []string) error {
+	for _, dir := range dirs {
+		if err := os.Remove(dir); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
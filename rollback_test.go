@@ -0,0 +1,316 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"syscall"
+	"testing"
+	"time"
+
+	"sigs.k8s.io/sig-storage-lib-external-provisioner/v13/controller"
+
+	v1 "k8s.io/api/core/v1"
+)
+
+const fakeBackendName = "fake"
+
+// fakeBackend is a multi-step backend which sets up (and releases) a directory
+// within the volume, and can be made to fail
+type fakeBackend struct {
+	// The error to fail the provisioning with (if any)
+	fails error
+
+	// The name of the directory set up within the volume
+	setup string
+
+	// If set, provisioning and releasing wait until it's closed
+	hold chan struct{}
+
+	provisioned []string
+	released    []string
+}
+
+func (b *fakeBackend) Provision(ctx context.Context, options controller.ProvisionOptions, finalPath string, permissions os.FileMode) (map[string]string, error) {
+	if b.hold != nil {
+		<-b.hold
+	}
+	if b.fails != nil {
+		return nil, b.fails
+	}
+	if err := os.Mkdir(path.Join(finalPath, b.setup), 0755); err != nil {
+		return nil, err
+	}
+	b.provisioned = append(b.provisioned, finalPath)
+	return nil, nil
+}
+
+func (b *fakeBackend) Release(ctx context.Context, fullPath string, annotations map[string]string) error {
+	if b.hold != nil {
+		<-b.hold
+	}
+	b.released = append(b.released, fullPath)
+	return os.RemoveAll(path.Join(fullPath, b.setup))
+}
+
+// useFakeBackend makes the fake backend the provisioner's only one
+func useFakeBackend(t *testing.T, p *HostPathProvisioner, backend *fakeBackend) {
+	knownBackends[fakeBackendName] = backend
+	backendAccessModes[fakeBackendName] = []v1.PersistentVolumeAccessMode{v1.ReadWriteOnce}
+	t.Cleanup(func() {
+		delete(knownBackends, fakeBackendName)
+		delete(backendAccessModes, fakeBackendName)
+	})
+	p.Backends = []string{fakeBackendName}
+	p.DefaultBackend = fakeBackendName
+}
+
+// listTree lists every path below the given directory
+func listTree(t *testing.T, root string) []string {
+	t.Helper()
+	var result []string
+	err := filepath.WalkDir(root, func(name string, entry fs.DirEntry, err error) error {
+		if err == nil && name != root {
+			result = append(result, name[len(root)+1:])
+		}
+		return err
+	})
+	if err != nil {
+		t.Fatalf("Failed to list [%s]: %s", root, err)
+	}
+	return result
+}
+
+func TestProvisionRollback(t *testing.T) {
+	for _, test := range []struct {
+		name     string
+		inject   func(t *testing.T, p *HostPathProvisioner, backend *fakeBackend)
+		released bool
+	}{
+		{
+			name: "backend",
+			inject: func(t *testing.T, p *HostPathProvisioner, backend *fakeBackend) {
+				backend.fails = errors.New("injected failure")
+			},
+		},
+		{
+			name: "chmod",
+			inject: func(t *testing.T, p *HostPathProvisioner, backend *fakeBackend) {
+				// The file system won't honor the requested mode
+				p.ModeMismatch = modeMismatchFail
+				t.Cleanup(func() { chmod = os.Chmod })
+				chmod = func(name string, mode os.FileMode) error {
+					return os.Chmod(name, mode^0001)
+				}
+			},
+			released: true,
+		},
+		{
+			name: "marker",
+			inject: func(t *testing.T, p *HostPathProvisioner, backend *fakeBackend) {
+				// The marker can't be written over the backend's directory
+				p.MarkerFile = "setup"
+			},
+			released: true,
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			p := newTestProvisioner(t)
+			p.RollbackOnFailure = true
+			backend := &fakeBackend{setup: "setup"}
+			useFakeBackend(t, p, backend)
+			if err := os.Mkdir(path.Join(p.HostPathMount, "existing"), 0755); err != nil {
+				t.Fatalf("Failed to create the pre-existing directory: %s", err)
+			}
+			test.inject(t, p, backend)
+
+			claim := testClaim("claim", map[string]string{locationAnnotation: "existing/nested/volume"})
+			if _, _, err := p.Provision(context.Background(), testOptions("pv", claim, testClass("standard", nil))); err == nil {
+				t.Fatalf("Expected the provisioning to fail")
+			}
+
+			volumePath := path.Join(p.HostPathMount, "existing/nested/volume")
+			if test.released {
+				if !slices.Equal(backend.released, []string{volumePath}) {
+					t.Errorf("Expected the backend to be released for [%s], got %v", volumePath, backend.released)
+				}
+			} else if len(backend.released) > 0 {
+				t.Errorf("The backend was released despite never being set up: %v", backend.released)
+			}
+			// Only the directories the failed attempt created are removed
+			if tree := listTree(t, p.HostPathMount); !slices.Equal(tree, []string{"existing"}) {
+				t.Errorf("The failed provisioning left residue behind: %v", tree)
+			}
+		})
+	}
+}
+
+func TestProvisionWithoutRollback(t *testing.T) {
+	p := newTestProvisioner(t)
+	p.RollbackOnFailure = false
+	p.MarkerFile = "setup"
+	backend := &fakeBackend{setup: "setup"}
+	useFakeBackend(t, p, backend)
+
+	if _, _, err := p.Provision(context.Background(), testOptions("pv", testClaim("claim", nil), testClass("standard", nil))); err == nil {
+		t.Fatalf("Expected the provisioning to fail")
+	}
+	if len(backend.released) > 0 {
+		t.Errorf("The backend was released with the rollback disabled: %v", backend.released)
+	}
+	if tree := listTree(t, p.HostPathMount); !slices.Equal(tree, []string{"pv", "pv/setup"}) {
+		t.Errorf("Expected the failed attempt's residue to remain, got %v", tree)
+	}
+}
+
+func TestRollbackOrder(t *testing.T) {
+	var order []string
+	undo := &rollback{}
+	for _, name := range []string{"first", "second", "third"} {
+		undo.add(name, func() error {
+			order = append(order, name)
+			if name == "second" {
+				return errors.New("injected failure")
+			}
+			return nil
+		})
+	}
+	undo.run()
+	if expected := []string{"third", "second", "first"}; !slices.Equal(order, expected) {
+		t.Errorf("Expected the steps to be undone in the order %v, got %v", expected, order)
+	}
+	undo.run()
+	if len(order) != 3 {
+		t.Errorf("The steps were undone more than once: %v", order)
+	}
+}
+
+// failLaterStep makes the provisioning fail after the backend has set up the
+// volume: the slow provisioning event can't be posted, which fails it in
+// strict mode
+func failLaterStep(p *HostPathProvisioner) {
+	p.StrictAuxiliary = true
+	p.SlowProvisionThreshold = time.Nanosecond
+	p.SlowProvisionEvent = true
+	failAPI(p, "create", "events")
+}
+
+func TestBindReadOnlyRollback(t *testing.T) {
+	for _, test := range []struct {
+		name   string
+		inject func(p *HostPathProvisioner, mounts *fakeMountTable)
+	}{
+		{name: "bind", inject: func(p *HostPathProvisioner, mounts *fakeMountTable) { mounts.mountErr = syscall.EPERM }},
+		{name: "remount", inject: func(p *HostPathProvisioner, mounts *fakeMountTable) { mounts.remountErr = syscall.EPERM }},
+		{name: "later step", inject: func(p *HostPathProvisioner, mounts *fakeMountTable) { failLaterStep(p) }},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			p, mounts, source, options := newBindReadOnlyTest(t)
+			p.RollbackOnFailure = true
+			test.inject(p, mounts)
+
+			if _, _, err := p.Provision(context.Background(), options); err == nil {
+				t.Fatalf("Expected the provisioning to fail")
+			}
+			volumePath := path.Join(p.HostPathMount, "pv")
+			if entry, err := findMount(volumePath); err != nil || entry != nil {
+				t.Errorf("The failed provisioning left [%s] mounted: %+v (%v)", volumePath, entry, err)
+			}
+			if tree := listTree(t, p.HostPathMount); len(tree) > 0 {
+				t.Errorf("The failed provisioning left residue behind: %v", tree)
+			}
+			if data, err := os.ReadFile(path.Join(source, "shared")); err != nil || string(data) != "shared data" {
+				t.Errorf("The shared source was altered by the rollback: [%s] (%v)", data, err)
+			}
+		})
+	}
+}
+
+func TestQuotaRollback(t *testing.T) {
+	for _, test := range []struct {
+		name   string
+		inject func(p *HostPathProvisioner, projects *fakeProjects, volumePath string)
+	}{
+		{name: "listing", inject: func(p *HostPathProvisioner, projects *fakeProjects, volumePath string) {
+			failAPI(p, "list", "persistentvolumes")
+		}},
+		{name: "assignment", inject: func(p *HostPathProvisioner, projects *fakeProjects, volumePath string) {
+			// The directory itself is assigned last, after its contents
+			projects.assignErr[volumePath] = syscall.EPERM
+		}},
+		{name: "quota", inject: func(p *HostPathProvisioner, projects *fakeProjects, volumePath string) {
+			// Project quotas aren't enabled
+			projects.quotaErr = syscall.ESRCH
+		}},
+		{name: "later step", inject: func(p *HostPathProvisioner, projects *fakeProjects, volumePath string) {
+			failLaterStep(p)
+		}},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			p := newTestProvisioner(t)
+			p.RollbackOnFailure = true
+			p.Backends = []string{quotaBackendName}
+			p.DefaultBackend = quotaBackendName
+			projects := stubProjects(t)
+
+			// A previous attempt left the volume's directory (and some data) behind,
+			// within a directory with a quota of its own
+			parentPath := path.Join(p.HostPathMount, "shared")
+			volumePath := path.Join(parentPath, "pv")
+			if err := os.MkdirAll(volumePath, 0755); err != nil {
+				t.Fatalf("Failed to create the volume directory: %s", err)
+			}
+			if err := os.WriteFile(path.Join(volumePath, "data"), []byte("data"), 0644); err != nil {
+				t.Fatalf("Failed to create the volume's contents: %s", err)
+			}
+			projects.ids[parentPath] = 500
+			projects.inherit[parentPath] = true
+			projects.limits[500] = 10 << 30
+			test.inject(p, projects, volumePath)
+
+			claim := testClaim("claim", map[string]string{locationAnnotation: "shared/pv"})
+			if _, _, err := p.Provision(context.Background(), testOptions("pv", claim, testClass("standard", nil))); err == nil {
+				t.Fatalf("Expected the provisioning to fail")
+			}
+
+			// Everything's back in the parent's project, as it was
+			for _, file := range []string{volumePath, path.Join(volumePath, "data")} {
+				info, err := os.Stat(file)
+				if err != nil {
+					t.Fatalf("[%s] was removed: %s", file, err)
+				}
+				if id, inherit, _ := getProjectID(file); id != 500 || inherit != info.IsDir() {
+					t.Errorf("Expected [%s] back in project 500 (inheriting: %t), got %d (inheriting: %t)", file, info.IsDir(), id, inherit)
+				}
+			}
+			for id, limit := range projects.limits {
+				if id != 500 && limit != 0 {
+					t.Errorf("The quota for project %d was left at %d bytes", id, limit)
+				}
+			}
+			if projects.limits[500] != 10<<30 {
+				t.Errorf("The parent's quota was changed: %v", projects.limits)
+			}
+		})
+	}
+}
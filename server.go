@@ -0,0 +1,51 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"net"
+	"net/http"
+
+	klog "k8s.io/klog/v2"
+)
+
+// startHTTPServer serves the provisioner's own endpoints (/readyz, and /events
+// and /debug/operations if they're enabled) at the given address, in the
+// background. These don't depend on the controller, so they're answered while
+// the provisioner starts up, and on the replicas which aren't the leader.
+func (p *HostPathProvisioner) startHTTPServer(address string) (net.Listener, error) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/readyz", p.serveReadiness)
+	if p.events != nil {
+		mux.HandleFunc("/events", p.events.serveEvents)
+	}
+	if p.operations != nil {
+		mux.HandleFunc("/debug/operations", p.operations.serveOperations)
+	}
+
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return nil, err
+	}
+	klog.Infof("Serving the provisioner's endpoints on %s", listener.Addr())
+	go func() {
+		if err := http.Serve(listener, mux); err != nil {
+			klog.Errorf("Stopped serving the provisioner's endpoints on %s: %s", listener.Addr(), err)
+		}
+	}()
+	return listener, nil
+}
@@ -0,0 +1,101 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// statusOf requests the given path from the server, returning the status code
+// and the Content-Type
+func statusOf(t *testing.T, listener net.Listener, path string) (int, string) {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://"+listener.Addr().String()+path, nil)
+	if err != nil {
+		t.Fatalf("Failed to build the request: %s", err)
+	}
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		t.Fatalf("Failed to request [%s]: %s", path, err)
+	}
+	defer response.Body.Close()
+	return response.StatusCode, response.Header.Get("Content-Type")
+}
+
+func TestHTTPServer(t *testing.T) {
+	for _, enabled := range []bool{false, true} {
+		name := "disabled"
+		if enabled {
+			name = "enabled"
+		}
+		t.Run(name, func(t *testing.T) {
+			p := newTestProvisioner(t)
+			p.Client = newAPIServer(t, http.StatusOK)
+			stubStatfs(t, 1000, 1000)
+			p.ReadinessDetail = true
+			if enabled {
+				p.events = newEventBroker(10)
+				p.operations = newOperationTracker(true)
+			}
+
+			// Nothing else has been started: there's no controller, let alone a
+			// leader, and the endpoints are served all the same
+			listener, err := p.startHTTPServer("127.0.0.1:0")
+			if err != nil {
+				t.Fatalf("Failed to start the server: %s", err)
+			}
+			t.Cleanup(func() { listener.Close() })
+
+			status, contentType := statusOf(t, listener, "/readyz")
+			if status != http.StatusOK || contentType != "application/json" {
+				t.Errorf("Expected /readyz to report the JSON readiness, got %d (%s)", status, contentType)
+			}
+			expected := http.StatusNotFound
+			if enabled {
+				expected = http.StatusOK
+			}
+			for _, path := range []string{"/events", "/debug/operations"} {
+				if status, _ := statusOf(t, listener, path); status != expected {
+					t.Errorf("Expected %s to return %d, got %d", path, expected, status)
+				}
+			}
+			if status, _ := statusOf(t, listener, "/metrics"); status != http.StatusNotFound {
+				t.Errorf("Expected the metrics to be left to the controller, got %d", status)
+			}
+		})
+	}
+}
+
+func TestHTTPServerPortTaken(t *testing.T) {
+	p := newTestProvisioner(t)
+	listener, err := p.startHTTPServer("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to start the server: %s", err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	if second, err := p.startHTTPServer(listener.Addr().String()); err == nil {
+		second.Close()
+		t.Errorf("Expected the second server to fail on the same port")
+	}
+}
@@ -0,0 +1,63 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"math/rand/v2"
+	"time"
+
+	klog "k8s.io/klog/v2"
+)
+
+// A startupTask is a background task (i.e. a scan) started along with the
+// provisioner
+type startupTask struct {
+	name string
+	run  func(ctx context.Context)
+}
+
+// startupDelay computes how long the startup task at the given position waits
+// before it starts
+func (p *HostPathProvisioner) startupDelay(position int) time.Duration {
+	delay := time.Duration(position) * p.StartupStagger
+	if p.StartupJitter > 0 {
+		delay += rand.N(p.StartupJitter)
+	}
+	return delay
+}
+
+// runStartupTasks starts the given tasks in the background, each one delayed by
+// the configured stagger and jitter so they don't all load the API server and
+// the disk at once (i.e. when a whole fleet restarts together). Nothing waits
+// on them, so they never hold up readiness.
+func (p *HostPathProvisioner) runStartupTasks(ctx context.Context, tasks []startupTask) {
+	for position, task := range tasks {
+		delay := p.startupDelay(position)
+		go func() {
+			if delay > 0 {
+				klog.Infof("Starting the %s in %s", task.name, delay)
+				select {
+				case <-ctx.Done():
+					return
+				case <-time.After(delay):
+				}
+			}
+			task.run(ctx)
+		}()
+	}
+}
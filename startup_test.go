@@ -0,0 +1,141 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// timedTasks builds the given number of startup tasks, each of which reports
+// its position and how long after the returned start time it began
+func timedTasks(count int) ([]startupTask, time.Time, chan [2]int64) {
+	start := time.Now()
+	started := make(chan [2]int64, count)
+	var tasks []startupTask
+	for position := range count {
+		tasks = append(tasks, startupTask{fmt.Sprintf("task %d", position), func(ctx context.Context) {
+			started <- [2]int64{int64(position), int64(time.Since(start))}
+		}})
+	}
+	return tasks, start, started
+}
+
+func TestStartupStagger(t *testing.T) {
+	p := newTestProvisioner(t)
+	p.StartupStagger = 100 * time.Millisecond
+	tasks, start, started := timedTasks(3)
+
+	p.runStartupTasks(context.Background(), tasks)
+	if elapsed := time.Since(start); elapsed >= p.StartupStagger {
+		t.Errorf("Expected the tasks to be started in the background, but waited %s", elapsed)
+	}
+
+	for expected := range 3 {
+		select {
+		case result := <-started:
+			position, elapsed := int(result[0]), time.Duration(result[1])
+			if position != expected {
+				t.Errorf("Expected task %d to start next, got task %d", expected, position)
+			}
+			if earliest := time.Duration(position) * p.StartupStagger; elapsed < earliest {
+				t.Errorf("Expected task %d to start after %s, but it started after %s", position, earliest, elapsed)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Task %d never started", expected)
+		}
+	}
+}
+
+func TestStartupWithoutStagger(t *testing.T) {
+	p := newTestProvisioner(t)
+	tasks, _, started := timedTasks(3)
+
+	p.runStartupTasks(context.Background(), tasks)
+	for range 3 {
+		select {
+		case result := <-started:
+			if elapsed := time.Duration(result[1]); elapsed >= time.Second {
+				t.Errorf("Expected task %d to start immediately, but it started after %s", result[0], elapsed)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Not all the tasks started")
+		}
+	}
+}
+
+func TestStartupDelay(t *testing.T) {
+	p := newTestProvisioner(t)
+	p.StartupStagger = time.Minute
+	p.StartupJitter = 10 * time.Second
+
+	for position := range 5 {
+		earliest := time.Duration(position) * p.StartupStagger
+		for range 100 {
+			if delay := p.startupDelay(position); delay < earliest || delay >= earliest+p.StartupJitter {
+				t.Fatalf("Expected the delay at position %d within [%s, %s), got %s", position, earliest, earliest+p.StartupJitter, delay)
+			}
+		}
+	}
+}
+
+func TestStartupCancelled(t *testing.T) {
+	p := newTestProvisioner(t)
+	p.StartupStagger = time.Hour
+	tasks, _, started := timedTasks(2)
+	ctx, cancel := context.WithCancel(context.Background())
+
+	p.runStartupTasks(ctx, tasks)
+	select {
+	case <-started:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("The first task never started")
+	}
+
+	// The second one is still waiting its turn, and never gets it
+	cancel()
+	select {
+	case result := <-started:
+		t.Errorf("Expected task %d not to start once cancelled", result[0])
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestStartupReadiness(t *testing.T) {
+	p := newTestProvisioner(t)
+	p.Client = newAPIServer(t, http.StatusOK)
+	stubStatfs(t, 1000, 1000)
+
+	// The tasks are still running (or waiting to), yet the provisioner's ready
+	release := make(chan struct{})
+	t.Cleanup(func() { close(release) })
+	block := func(ctx context.Context) { <-release }
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	p.StartupStagger = time.Hour
+	p.runStartupTasks(ctx, []startupTask{{"first scan", block}, {"second scan", block}})
+
+	recorder := httptest.NewRecorder()
+	p.serveReadiness(recorder, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	if recorder.Code != http.StatusOK {
+		t.Errorf("Expected the status %d while the startup tasks run, got %d", http.StatusOK, recorder.Code)
+	}
+}
@@ -0,0 +1,163 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	klog "k8s.io/klog/v2"
+)
+
+// How often the readiness is re-evaluated for the status file
+const statusRefreshInterval = 30 * time.Second
+
+// The contents of the node-local status file
+type provisionerStatus struct {
+	Ready          bool      `json:"ready"`
+	OwnedVolumes   int       `json:"ownedVolumes"`
+	CommittedBytes int64     `json:"committedBytes"`
+	Backend        string    `json:"backend"`
+	LastError      string    `json:"lastError,omitempty"`
+	LastErrorTime  time.Time `json:"lastErrorTime,omitzero"`
+}
+
+// statusFile keeps the node-local status file up to date. All its methods are
+// safe to call on a nil instance, which does nothing.
+type statusFile struct {
+	path   string
+	lock   sync.Mutex
+	status provisionerStatus
+}
+
+func newStatusFile(path string, backend string) *statusFile {
+	if path == "" {
+		return nil
+	}
+	return &statusFile{
+		path:   path,
+		status: provisionerStatus{Backend: backend},
+	}
+}
+
+// update applies the given change to the status, and rewrites the file if
+// anything actually changed
+func (s *statusFile) update(change func(status *provisionerStatus)) {
+	if s == nil {
+		return
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	before := s.status
+	change(&s.status)
+	if s.status == before {
+		return
+	}
+	if err := s.write(); err != nil {
+		klog.Warningf("Failed to write the status file [%s]: %s", s.path, err)
+	}
+}
+
+// write atomically replaces the status file's contents. Must be called with
+// the lock held.
+func (s *statusFile) write() error {
+	data, err := json.MarshalIndent(s.status, "", "  ")
+	if err != nil {
+		return err
+	}
+	temp, err := os.CreateTemp(filepath.Dir(s.path), filepath.Base(s.path)+".")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(temp.Name())
+	if _, err := temp.Write(append(data, '\n')); err != nil {
+		temp.Close()
+		return err
+	}
+	if err := temp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(temp.Name(), 0644); err != nil {
+		return err
+	}
+	return os.Rename(temp.Name(), s.path)
+}
+
+func volumeBytes(volume *v1.PersistentVolume) int64 {
+	capacity := volume.Spec.Capacity[v1.ResourceStorage]
+	return capacity.Value()
+}
+
+func (s *statusFile) provisioned(volume *v1.PersistentVolume) {
+	s.update(func(status *provisionerStatus) {
+		status.OwnedVolumes++
+		status.CommittedBytes += volumeBytes(volume)
+	})
+}
+
+func (s *statusFile) deleted(volume *v1.PersistentVolume) {
+	s.update(func(status *provisionerStatus) {
+		status.OwnedVolumes = max(status.OwnedVolumes-1, 0)
+		status.CommittedBytes = max(status.CommittedBytes-volumeBytes(volume), 0)
+	})
+}
+
+func (s *statusFile) failed(err error) {
+	s.update(func(status *provisionerStatus) {
+		status.LastError = err.Error()
+		status.LastErrorTime = time.Now().UTC().Truncate(time.Second)
+	})
+}
+
+func (s *statusFile) ready(ready bool) {
+	s.update(func(status *provisionerStatus) {
+		status.Ready = ready
+	})
+}
+
+// seedStatusFile seeds the status file's totals from the owned PVs
+func (p *HostPathProvisioner) seedStatusFile(ctx context.Context) {
+	volumes, err := p.listOwnedVolumes(ctx)
+	if err != nil {
+		if err := p.auxiliaryFailed(auxiliaryListVolumes, err); err != nil {
+			klog.Errorf("Failed to seed the status file: %s", err)
+		}
+	} else {
+		bytes := int64(0)
+		for _, volume := range volumes {
+			bytes += volumeBytes(volume)
+		}
+		p.status.update(func(status *provisionerStatus) {
+			status.OwnedVolumes = len(volumes)
+			status.CommittedBytes = bytes
+		})
+	}
+}
+
+// runStatusFile keeps the status file's readiness current until the context is
+// cancelled
+func (p *HostPathProvisioner) runStatusFile(ctx context.Context) {
+	wait.UntilWithContext(ctx, func(ctx context.Context) {
+		p.checkReadiness(ctx)
+	}, statusRefreshInterval)
+}
@@ -0,0 +1,157 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"os"
+	"path"
+	"testing"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// readStatus parses the status file's current contents
+func readStatus(t *testing.T, p *HostPathProvisioner) provisionerStatus {
+	t.Helper()
+	data, err := os.ReadFile(p.StatusFile)
+	if err != nil {
+		t.Fatalf("Failed to read the status file: %s", err)
+	}
+	var status provisionerStatus
+	if err := json.Unmarshal(data, &status); err != nil {
+		t.Fatalf("Failed to parse the status file [%s]: %s", data, err)
+	}
+	return status
+}
+
+func newStatusProvisioner(t *testing.T) *HostPathProvisioner {
+	p := newTestProvisioner(t)
+	p.StatusFile = path.Join(t.TempDir(), "status.json")
+	p.status = newStatusFile(p.StatusFile, p.DefaultBackend)
+	return p
+}
+
+func TestStatusFileTransitions(t *testing.T) {
+	p := newStatusProvisioner(t)
+	ctx := context.Background()
+	const gigabyte = 1 << 30
+
+	// Nothing's written until there's something to report
+	if _, err := os.Stat(p.StatusFile); !os.IsNotExist(err) {
+		t.Fatalf("Expected no status file yet, got %v", err)
+	}
+
+	first, _, err := p.Provision(ctx, testOptions("pv-first", testClaim("claim-first", nil), testClass("standard", nil)))
+	if err != nil {
+		t.Fatalf("Failed to provision: %s", err)
+	}
+	status := readStatus(t, p)
+	if status.OwnedVolumes != 1 || status.CommittedBytes != gigabyte || status.Backend != directoryBackendName {
+		t.Errorf("Unexpected status after the first provisioning: %+v", status)
+	}
+
+	second, _, err := p.Provision(ctx, testOptions("pv-second", testClaim("claim-second", nil), testClass("standard", nil)))
+	if err != nil {
+		t.Fatalf("Failed to provision: %s", err)
+	}
+	if status := readStatus(t, p); status.OwnedVolumes != 2 || status.CommittedBytes != 2*gigabyte {
+		t.Errorf("Unexpected status after the second provisioning: %+v", status)
+	}
+
+	// Failures are recorded, without affecting the totals
+	claim := testClaim("claim-failed", map[string]string{locationAnnotation: "../outside"})
+	if _, _, err := p.Provision(ctx, testOptions("pv-failed", claim, testClass("standard", nil))); err == nil {
+		t.Fatalf("Expected the provisioning to fail")
+	}
+	status = readStatus(t, p)
+	if status.LastError == "" || status.LastErrorTime.IsZero() || status.OwnedVolumes != 2 {
+		t.Errorf("Unexpected status after the failed provisioning: %+v", status)
+	}
+
+	if err := p.Delete(ctx, first); err != nil {
+		t.Fatalf("Failed to delete: %s", err)
+	}
+	if status := readStatus(t, p); status.OwnedVolumes != 1 || status.CommittedBytes != gigabyte {
+		t.Errorf("Unexpected status after the first deletion: %+v", status)
+	}
+	if err := p.Delete(ctx, second); err != nil {
+		t.Fatalf("Failed to delete: %s", err)
+	}
+	if status := readStatus(t, p); status.OwnedVolumes != 0 || status.CommittedBytes != 0 {
+		t.Errorf("Unexpected status after the second deletion: %+v", status)
+	}
+}
+
+func TestStatusFileSeeding(t *testing.T) {
+	p := newStatusProvisioner(t)
+	ctx := context.Background()
+	const gigabyte = 1 << 30
+
+	for _, name := range []string{"pv-old-1", "pv-old-2"} {
+		volume := testVolume(t, p, name, name)
+		volume.Spec.Capacity = v1.ResourceList{v1.ResourceStorage: resource.MustParse("2Gi")}
+		if _, err := p.Client.CoreV1().PersistentVolumes().Create(ctx, volume, metav1.CreateOptions{}); err != nil {
+			t.Fatalf("Failed to create the PV: %s", err)
+		}
+	}
+
+	// The volumes provisioned after the seeding add to it, rather than being
+	// lost to it
+	p.seedStatusFile(ctx)
+	if status := readStatus(t, p); status.OwnedVolumes != 2 || status.CommittedBytes != 4*gigabyte {
+		t.Errorf("Unexpected status after the seeding: %+v", status)
+	}
+	if _, _, err := p.Provision(ctx, testOptions("pv-new", testClaim("claim-new", nil), testClass("standard", nil))); err != nil {
+		t.Fatalf("Provision failed: %s", err)
+	}
+	if status := readStatus(t, p); status.OwnedVolumes != 3 || status.CommittedBytes != 5*gigabyte {
+		t.Errorf("Unexpected status after the provisioning: %+v", status)
+	}
+}
+
+func TestStatusFileReadiness(t *testing.T) {
+	p := newStatusProvisioner(t)
+	p.Client = newAPIServer(t, http.StatusOK)
+	stubStatfs(t, 1000, 1000)
+
+	p.checkReadiness(context.Background())
+	if status := readStatus(t, p); !status.Ready {
+		t.Errorf("Expected the status to be ready: %+v", status)
+	}
+
+	p.MaintenanceFile = path.Join(p.PVDir, "maintenance")
+	if err := os.WriteFile(p.MaintenanceFile, nil, 0644); err != nil {
+		t.Fatalf("Failed to create the maintenance file: %s", err)
+	}
+	p.checkReadiness(context.Background())
+	if status := readStatus(t, p); status.Ready {
+		t.Errorf("Expected the status not to be ready: %+v", status)
+	}
+}
+
+func TestStatusFileDisabled(t *testing.T) {
+	// All the methods are safe to call on the nil instance
+	var status *statusFile
+	status.provisioned(nil)
+	status.deleted(nil)
+	status.ready(true)
+}
@@ -0,0 +1,72 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"fmt"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	klog "k8s.io/klog/v2"
+)
+
+const storageClassCheckOff = "off"
+const storageClassCheckWarn = "warn"
+const storageClassCheckFatal = "fatal"
+
+// findStorageClasses returns the names of the StorageClasses which reference
+// the given provisioner name
+func (p *HostPathProvisioner) findStorageClasses(ctx context.Context, provisionerName string) ([]string, error) {
+	classes, err := p.Client.StorageV1().StorageClasses().List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+	var result []string
+	for _, class := range classes.Items {
+		if class.Provisioner == provisionerName {
+			result = append(result, class.Name)
+		}
+	}
+	return result, nil
+}
+
+// checkStorageClasses verifies, on startup, that at least one StorageClass
+// references this provisioner's name, since otherwise nothing will ever be
+// provisioned and there'd be no other sign of the misconfiguration
+func (p *HostPathProvisioner) checkStorageClasses(ctx context.Context, provisionerName string) error {
+	if p.StorageClassCheck == storageClassCheckOff {
+		return nil
+	}
+
+	classes, err := p.findStorageClasses(ctx, provisionerName)
+	if err != nil {
+		// Not being able to tell isn't the misconfiguration we're looking for,
+		// unless auxiliary failures are meant to be fatal
+		return p.auxiliaryFailed(auxiliaryListStorageClasses, fmt.Errorf("failed to list the StorageClasses to verify the provisioner name [%s]: %w", provisionerName, err))
+	}
+	if len(classes) > 0 {
+		klog.Infof("The provisioner name [%s] is referenced by the StorageClasses %v", provisionerName, classes)
+		return nil
+	}
+
+	err = fmt.Errorf("no StorageClass references the provisioner name [%s] (check HOSTPATH_PROVISIONER_NAME), so no volumes will be provisioned", provisionerName)
+	if p.StorageClassCheck == storageClassCheckFatal {
+		return err
+	}
+	klog.Warningf("%s", err)
+	return nil
+}
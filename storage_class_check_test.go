@@ -0,0 +1,74 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"testing"
+
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+func TestCheckStorageClasses(t *testing.T) {
+	matching := testClass("hostpath", nil)
+	other := testClass("other", nil)
+	other.Provisioner = "example.com/other"
+
+	for _, test := range []struct {
+		name    string
+		check   string
+		classes []runtime.Object
+		fails   bool
+	}{
+		{name: "off without a matching class", check: storageClassCheckOff, classes: []runtime.Object{other}},
+		{name: "warn with a matching class", check: storageClassCheckWarn, classes: []runtime.Object{matching, other}},
+		{name: "warn without a matching class", check: storageClassCheckWarn, classes: []runtime.Object{other}},
+		{name: "fatal with a matching class", check: storageClassCheckFatal, classes: []runtime.Object{matching, other}},
+		{name: "fatal without a matching class", check: storageClassCheckFatal, classes: []runtime.Object{other}, fails: true},
+		{name: "fatal without any class", check: storageClassCheckFatal, fails: true},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			p := newTestProvisioner(t, test.classes...)
+			p.StorageClassCheck = test.check
+			err := p.checkStorageClasses(context.Background(), "hostpath")
+			if test.fails && err == nil {
+				t.Errorf("Expected the check to fail")
+			} else if !test.fails && err != nil {
+				t.Errorf("Expected the check to pass, got %s", err)
+			}
+		})
+	}
+}
+
+func TestStorageClassCheckSetting(t *testing.T) {
+	for value, expected := range map[string]string{
+		"":                     storageClassCheckOff,
+		storageClassCheckOff:   storageClassCheckOff,
+		storageClassCheckWarn:  storageClassCheckWarn,
+		storageClassCheckFatal: storageClassCheckFatal,
+		"bogus":                storageClassCheckOff,
+	} {
+		t.Run(value, func(t *testing.T) {
+			t.Setenv("NODE_NAME", testIdentity)
+			t.Setenv("HOSTPATH_STORAGE_CLASS_CHECK", value)
+			p := NewHostPathProvisioner(nil)
+			if p.StorageClassCheck != expected {
+				t.Errorf("Expected the check [%s] for the value [%s], got [%s]", expected, value, p.StorageClassCheck)
+			}
+		})
+	}
+}
@@ -0,0 +1,94 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"os"
+	"sort"
+	"strconv"
+
+	klog "k8s.io/klog/v2"
+)
+
+// The permissions used for volumes which don't specify any
+const defaultPermissions = os.FileMode(0755)
+
+// parseUmask parses the (octal) umask from HOSTPATH_UMASK, defaulting to 0 so
+// the directories are created with exactly the requested modes
+func parseUmask(value string) int {
+	if value == "" {
+		return 0
+	}
+	parsed, err := strconv.ParseUint(value, 8, 32)
+	if err != nil || parsed > 0777 {
+		klog.Warningf("The given HOSTPATH_UMASK value [%s] is not a valid octal umask, will use 0000", value)
+		return 0
+	}
+	return int(parsed)
+}
+
+// maskedMode computes the mode MkdirAll actually creates a directory with,
+// given the requested mode and the umask
+func maskedMode(requested os.FileMode, umask int) os.FileMode {
+	return requested.Perm() &^ os.FileMode(umask)
+}
+
+// configuredModes collects the directory modes the configuration may request:
+// the default, plus those in the profiles (if any). Modes requested by the PVCs'
+// annotations can't be known in advance.
+func (p *HostPathProvisioner) configuredModes() map[string]os.FileMode {
+	result := map[string]os.FileMode{"default": defaultPermissions}
+	if p.profiles == nil {
+		return result
+	}
+	profiles := map[string]volumeProfile{"default profile": p.profiles.Default}
+	for name, profile := range p.profiles.Profiles {
+		profiles["profile "+name] = profile
+	}
+	for source, profile := range profiles {
+		if profile.Perm == "" {
+			continue
+		}
+		// The profiles have already been validated
+		parsed, _ := strconv.ParseUint(profile.Perm, 8, 32)
+		result[source] = os.FileMode(parsed)
+	}
+	return result
+}
+
+// checkUmask logs the effective mode for each configured directory mode: the
+// umask applies when MkdirAll creates the directories, and the explicit Chmod
+// afterwards restores the requested mode. When the umask would alter a
+// requested mode, a warning may be issued, as the directory briefly exists
+// with the masked mode, and keeps it if the filesystem ignores the Chmod.
+func (p *HostPathProvisioner) checkUmask() {
+	modes := p.configuredModes()
+	sources := make([]string, 0, len(modes))
+	for source := range modes {
+		sources = append(sources, source)
+	}
+	sort.Strings(sources)
+
+	for _, source := range sources {
+		requested := modes[source].Perm()
+		masked := maskedMode(requested, p.Umask)
+		klog.Infof("Directory mode (%s): requested %04o, umask %04o, created as %04o, then set to %04o", source, requested, p.Umask, masked, requested)
+		if masked != requested && p.UmaskWarn {
+			klog.Warningf("The umask %04o alters the %s mode %04o (to %04o) until the explicit Chmod corrects it", p.Umask, source, requested, masked)
+		}
+	}
+}
@@ -0,0 +1,130 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	klog "k8s.io/klog/v2"
+)
+
+func TestCheckUmask(t *testing.T) {
+	profiles := &profileConfig{
+		Profiles: map[string]volumeProfile{
+			"private": {Perm: "0700"},
+			"shared":  {Perm: "0777"},
+			"inherit": {Backend: directoryBackendName},
+		},
+	}
+
+	for _, test := range []struct {
+		umask int
+		// The effective mode each source is created with
+		expected map[string]string
+		// The sources whose mode the umask alters
+		altered []string
+	}{
+		{
+			umask:    0000,
+			expected: map[string]string{"default": "0755", "profile private": "0700", "profile shared": "0777"},
+		},
+		{
+			umask:    0022,
+			expected: map[string]string{"default": "0755", "profile private": "0700", "profile shared": "0755"},
+			altered:  []string{"profile shared"},
+		},
+		{
+			umask:    0027,
+			expected: map[string]string{"default": "0750", "profile private": "0700", "profile shared": "0750"},
+			altered:  []string{"default", "profile shared"},
+		},
+		{
+			umask:    0077,
+			expected: map[string]string{"default": "0700", "profile private": "0700", "profile shared": "0700"},
+			altered:  []string{"default", "profile shared"},
+		},
+	} {
+		for _, warn := range []bool{false, true} {
+			t.Run(fmt.Sprintf("%04o/warn=%t", test.umask, warn), func(t *testing.T) {
+				p := newTestProvisioner(t)
+				p.profiles = profiles
+				p.Umask = test.umask
+				p.UmaskWarn = warn
+				logs := captureLogs(t)
+				p.checkUmask()
+				klog.Flush()
+
+				output := logs.String()
+				for source, effective := range test.expected {
+					line := fmt.Sprintf("Directory mode (%s): requested ", source)
+					index := strings.Index(output, line)
+					if index < 0 {
+						t.Errorf("The %s mode wasn't logged:\n%s", source, output)
+						continue
+					}
+					logged := output[index:]
+					logged = logged[:strings.IndexByte(logged, '\n')]
+					if !strings.Contains(logged, fmt.Sprintf("umask %04o, created as %s,", test.umask, effective)) {
+						t.Errorf("Expected the %s mode to be created as %s: %s", source, effective, logged)
+					}
+				}
+				if strings.Contains(output, "(profile inherit)") {
+					t.Errorf("A profile without a mode was logged:\n%s", output)
+				}
+
+				warnings := 0
+				for _, line := range strings.Split(output, "\n") {
+					if strings.HasPrefix(line, "W") && strings.Contains(line, "until the explicit Chmod corrects it") {
+						warnings++
+					}
+				}
+				if !warn {
+					if warnings > 0 {
+						t.Errorf("Expected no warnings when disabled:\n%s", output)
+					}
+					return
+				}
+				if warnings != len(test.altered) {
+					t.Errorf("Expected %d warnings, got %d:\n%s", len(test.altered), warnings, output)
+				}
+				for _, source := range test.altered {
+					if !strings.Contains(output, fmt.Sprintf("alters the %s mode", source)) {
+						t.Errorf("Expected a warning for the %s mode:\n%s", source, output)
+					}
+				}
+			})
+		}
+	}
+}
+
+func TestParseUmask(t *testing.T) {
+	for value, expected := range map[string]int{
+		"":     0,
+		"022":  0022,
+		"0077": 0077,
+		"0777": 0777,
+		"1000": 0,
+		"089":  0,
+		"bad":  0,
+	} {
+		if got := parseUmask(value); got != expected {
+			t.Errorf("Expected [%s] to parse as %04o, got %04o", value, expected, got)
+		}
+	}
+}
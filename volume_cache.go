@@ -0,0 +1,87 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+)
+
+// The name of the informer index which groups the PVs by provisioner identity
+const identityIndex = "identity"
+
+// newVolumeInformer creates the PV informer shared between the controller and
+// the features that need to find this provisioner's volumes, indexed by the
+// identity annotation so those lookups needn't scan every PV
+func newVolumeInformer(client kubernetes.Interface, resync time.Duration) (cache.SharedIndexInformer, error) {
+	factory := informers.NewSharedInformerFactory(client, resync)
+	informer := factory.Core().V1().PersistentVolumes().Informer()
+	err := informer.AddIndexers(cache.Indexers{
+		identityIndex: func(obj interface{}) ([]string, error) {
+			volume, ok := obj.(*v1.PersistentVolume)
+			if !ok {
+				return nil, nil
+			}
+			if identity, ok := volume.Annotations[provisionerIdentityAnnotation]; ok {
+				return []string{identity}, nil
+			}
+			return nil, nil
+		},
+	})
+	return informer, err
+}
+
+// listOwnedVolumes returns this provisioner's PVs: from the shared cache if it's
+// enabled, or straight from the API otherwise. The returned PVs must not be
+// modified, as they may be shared with the cache.
+func (p *HostPathProvisioner) listOwnedVolumes(ctx context.Context) ([]*v1.PersistentVolume, error) {
+	if p.volumeInformer != nil {
+		if !cache.WaitForCacheSync(ctx.Done(), p.volumeInformer.HasSynced) {
+			return nil, errors.New("the PV cache failed to sync")
+		}
+		objects, err := p.volumeInformer.GetIndexer().ByIndex(identityIndex, p.Identity)
+		if err != nil {
+			return nil, err
+		}
+		result := make([]*v1.PersistentVolume, 0, len(objects))
+		for _, obj := range objects {
+			if volume, ok := obj.(*v1.PersistentVolume); ok {
+				result = append(result, volume)
+			}
+		}
+		return result, nil
+	}
+
+	volumes, err := p.Client.CoreV1().PersistentVolumes().List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+	var result []*v1.PersistentVolume
+	for i := range volumes.Items {
+		if volumes.Items[i].Annotations[provisionerIdentityAnnotation] == p.Identity {
+			result = append(result, &volumes.Items[i])
+		}
+	}
+	return result, nil
+}
@@ -0,0 +1,139 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"slices"
+	"testing"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+// ownedVolumeNames lists the names of the provisioner's volumes
+func ownedVolumeNames(t *testing.T, p *HostPathProvisioner) []string {
+	t.Helper()
+	volumes, err := p.listOwnedVolumes(context.Background())
+	if err != nil {
+		t.Fatalf("Failed to list the owned volumes: %s", err)
+	}
+	var names []string
+	for _, volume := range volumes {
+		names = append(names, volume.Name)
+	}
+	slices.Sort(names)
+	return names
+}
+
+// countListActions counts the PV listings which reached the API
+func countListActions(p *HostPathProvisioner) int {
+	count := 0
+	for _, action := range p.Client.(*fake.Clientset).Actions() {
+		if action.GetVerb() == "list" && action.GetResource().Resource == "persistentvolumes" {
+			count++
+		}
+	}
+	return count
+}
+
+// waitForOwnedVolumes waits for the owned volumes to match the given names, as
+// the cache catches up with the API
+func waitForOwnedVolumes(t *testing.T, p *HostPathProvisioner, expected ...string) {
+	t.Helper()
+	var names []string
+	err := wait.PollUntilContextTimeout(context.Background(), 10*time.Millisecond, 5*time.Second, true, func(context.Context) (bool, error) {
+		names = ownedVolumeNames(t, p)
+		return slices.Equal(names, expected), nil
+	})
+	if err != nil {
+		t.Fatalf("Expected the owned volumes %v, got %v", expected, names)
+	}
+}
+
+func TestVolumeCache(t *testing.T) {
+	p := newTestProvisioner(t)
+	foreign := testVolume(t, p, "pv-foreign", "pv-foreign")
+	foreign.Annotations[provisionerIdentityAnnotation] = "another-node"
+	if _, err := p.Client.CoreV1().PersistentVolumes().Create(context.Background(), foreign, metav1.CreateOptions{}); err != nil {
+		t.Fatalf("Failed to create the PV: %s", err)
+	}
+
+	informer, err := newVolumeInformer(p.Client, time.Minute)
+	if err != nil {
+		t.Fatalf("Failed to create the PV cache: %s", err)
+	}
+	p.volumeInformer = informer
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go informer.Run(ctx.Done())
+
+	waitForOwnedVolumes(t, p)
+	lists := countListActions(p)
+
+	// The PVs are created and deleted the way the controller would, on the
+	// provisioner's behalf
+	class := testClass("standard", nil)
+	for _, name := range []string{"pv-a", "pv-b"} {
+		volume, _, err := p.Provision(context.Background(), testOptions(name, testClaim("claim-"+name, nil), class))
+		if err != nil {
+			t.Fatalf("Failed to provision %s: %s", name, err)
+		}
+		if _, err := p.Client.CoreV1().PersistentVolumes().Create(context.Background(), volume, metav1.CreateOptions{}); err != nil {
+			t.Fatalf("Failed to create the PV: %s", err)
+		}
+	}
+	waitForOwnedVolumes(t, p, "pv-a", "pv-b")
+
+	volume, err := p.Client.CoreV1().PersistentVolumes().Get(context.Background(), "pv-a", metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("Failed to get the PV: %s", err)
+	}
+	if err := p.Delete(context.Background(), volume); err != nil {
+		t.Fatalf("Failed to delete the volume: %s", err)
+	}
+	if err := p.Client.CoreV1().PersistentVolumes().Delete(context.Background(), "pv-a", metav1.DeleteOptions{}); err != nil {
+		t.Fatalf("Failed to delete the PV: %s", err)
+	}
+	waitForOwnedVolumes(t, p, "pv-b")
+
+	if got := countListActions(p); got != lists {
+		t.Errorf("The owned volumes were listed from the API %d times despite the cache", got-lists)
+	}
+}
+
+func TestVolumeListingWithoutCache(t *testing.T) {
+	p := newTestProvisioner(t)
+	for _, name := range []string{"pv-a", "pv-b", "pv-foreign"} {
+		volume := testVolume(t, p, name, name)
+		if name == "pv-foreign" {
+			volume.Annotations[provisionerIdentityAnnotation] = "another-node"
+		}
+		if _, err := p.Client.CoreV1().PersistentVolumes().Create(context.Background(), volume, metav1.CreateOptions{}); err != nil {
+			t.Fatalf("Failed to create the PV: %s", err)
+		}
+	}
+
+	if names := ownedVolumeNames(t, p); !slices.Equal(names, []string{"pv-a", "pv-b"}) {
+		t.Errorf("Expected the owned volumes [pv-a pv-b], got %v", names)
+	}
+	if got := countListActions(p); got != 1 {
+		t.Errorf("Expected a single listing from the API, got %d", got)
+	}
+}
@@ -0,0 +1,64 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/util/retry"
+	klog "k8s.io/klog/v2"
+)
+
+// updateBackoff computes the backoff used when retrying PV updates which hit a
+// conflict, allowing for the configured number of attempts
+func (p *HostPathProvisioner) updateBackoff() wait.Backoff {
+	return wait.Backoff{
+		Steps:    max(p.UpdateRetries, 1),
+		Duration: 10 * time.Millisecond,
+		Factor:   2.0,
+		Jitter:   0.1,
+		Cap:      time.Second,
+	}
+}
+
+// updateVolume applies the given change to the named PV and updates it. If the
+// update conflicts with someone else's, the PV is fetched anew and the change
+// re-applied, within the configured retry budget. The change function returns
+// false if there's nothing to update. All the code which modifies PVs should
+// go through here.
+func (p *HostPathProvisioner) updateVolume(ctx context.Context, name string, change func(volume *v1.PersistentVolume) bool) error {
+	attempt := 0
+	return retry.RetryOnConflict(p.updateBackoff(), func() error {
+		attempt++
+		volume, err := p.Client.CoreV1().PersistentVolumes().Get(ctx, name, metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+		if !change(volume) {
+			return nil
+		}
+		_, err = p.Client.CoreV1().PersistentVolumes().Update(ctx, volume, metav1.UpdateOptions{})
+		if err != nil {
+			klog.V(2).Infof("Update attempt %d for volume %s failed: %s", attempt, name, err)
+		}
+		return err
+	})
+}
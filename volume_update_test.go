@@ -0,0 +1,108 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"testing"
+
+	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+// injectConflicts makes the first count PV updates fail with a conflict, and
+// returns a pointer to the number of updates attempted
+func injectConflicts(p *HostPathProvisioner, count int) *int {
+	attempts := 0
+	p.Client.(*fake.Clientset).PrependReactor("update", "persistentvolumes", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		attempts++
+		if attempts > count {
+			return false, nil, nil
+		}
+		name := action.(k8stesting.UpdateAction).GetObject().(*v1.PersistentVolume).Name
+		return true, nil, apierrors.NewConflict(v1.Resource("persistentvolumes"), name, nil)
+	})
+	return &attempts
+}
+
+func setTestAnnotation(volume *v1.PersistentVolume) bool {
+	if volume.Annotations == nil {
+		volume.Annotations = map[string]string{}
+	}
+	volume.Annotations["test"] = "updated"
+	return true
+}
+
+func TestUpdateVolumeConflicts(t *testing.T) {
+	for _, test := range []struct {
+		name      string
+		retries   int
+		conflicts int
+		success   bool
+	}{
+		{name: "no conflicts", retries: 3, conflicts: 0, success: true},
+		{name: "within the budget", retries: 3, conflicts: 2, success: true},
+		{name: "exhausts the budget", retries: 3, conflicts: 3, success: false},
+		{name: "a single attempt", retries: 0, conflicts: 1, success: false},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			p := newTestProvisioner(t, &v1.PersistentVolume{ObjectMeta: metav1.ObjectMeta{Name: "pv"}})
+			p.UpdateRetries = test.retries
+			attempts := injectConflicts(p, test.conflicts)
+
+			err := p.updateVolume(context.Background(), "pv", setTestAnnotation)
+			if test.success {
+				if err != nil {
+					t.Fatalf("The update failed: %s", err)
+				}
+				if *attempts != test.conflicts+1 {
+					t.Errorf("Expected %d update attempts, got %d", test.conflicts+1, *attempts)
+				}
+				volume, err := p.Client.CoreV1().PersistentVolumes().Get(context.Background(), "pv", metav1.GetOptions{})
+				if err != nil {
+					t.Fatalf("Failed to get the PV: %s", err)
+				}
+				if volume.Annotations["test"] != "updated" {
+					t.Errorf("The change wasn't applied: %v", volume.Annotations)
+				}
+				return
+			}
+			if !apierrors.IsConflict(err) {
+				t.Fatalf("Expected a conflict error once the budget ran out, got %v", err)
+			}
+			if *attempts != max(test.retries, 1) {
+				t.Errorf("Expected %d update attempts, got %d", max(test.retries, 1), *attempts)
+			}
+		})
+	}
+}
+
+func TestUpdateVolumeNoChange(t *testing.T) {
+	p := newTestProvisioner(t, &v1.PersistentVolume{ObjectMeta: metav1.ObjectMeta{Name: "pv"}})
+	attempts := injectConflicts(p, 0)
+	err := p.updateVolume(context.Background(), "pv", func(*v1.PersistentVolume) bool { return false })
+	if err != nil {
+		t.Fatalf("The update failed: %s", err)
+	}
+	if *attempts != 0 {
+		t.Errorf("Expected no update when there's nothing to change, got %d", *attempts)
+	}
+}